@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+)
+
+// 分割したdescriptionの先頭チャンクに付与するヘッダ
+// "<バージョン>:<チャンク数>:<データ長>:<CRC32>:<セッションID>|"の形式で、データはヘッダの直後から始まる
+const chunkHeaderSeparator = "|"
+
+// chunkHeader はヘッダのうちデータの検証以外に使う値
+// バージョンはdescriptionのエンコード方式、セッションIDはofferとanswerの対応付けに使用する
+type chunkHeader struct {
+	version   string
+	sessionID string
+}
+
+// encodeChunks はデータにヘッダを付与してチャンクサイズごとに分割する
+// maxChunks個に収まらない場合はエラーを返す
+func encodeChunks(data []byte, header chunkHeader, chunkSize, maxChunks int) ([]string, error) {
+	checksum := crc32.ChecksumIEEE(data)
+	// ヘッダ長はチャンク数の桁数で変わるため、チャンク数が確定するまで計算を繰り返す
+	count := 1
+	var payload string
+	for {
+		headerString := fmt.Sprintf("%s:%d:%d:%08x:%s%s", header.version, count, len(data), checksum, header.sessionID, chunkHeaderSeparator)
+		payload = headerString + string(data)
+		needed := (len(payload) + chunkSize - 1) / chunkSize
+		if needed == count {
+			break
+		}
+		count = needed
+	}
+	if count > maxChunks {
+		return nil, fmt.Errorf("description too large (%d bytes, max %d chunks)", len(data), maxChunks)
+	}
+	chunks := make([]string, count)
+	for i := 0; i < count; i++ {
+		if i == count-1 {
+			chunks[i] = payload[(i * chunkSize):]
+		} else {
+			chunks[i] = payload[(i * chunkSize):((i + 1) * chunkSize)]
+		}
+	}
+	return chunks, nil
+}
+
+// decodeChunks はreadChunkで先頭チャンクから順に読み出して結合し、ヘッダの長さとチェックサムを検証する
+func decodeChunks(readChunk func(index int) (string, error), maxChunks int) ([]byte, chunkHeader, error) {
+	first, err := readChunk(0)
+	if err != nil {
+		return nil, chunkHeader{}, err
+	}
+	separatorIndex := strings.Index(first, chunkHeaderSeparator)
+	if separatorIndex < 0 {
+		return nil, chunkHeader{}, errors.New("chunk header not found")
+	}
+	fields := strings.Split(first[:separatorIndex], ":")
+	if len(fields) != 5 || !isSupportedDescriptionEncoding(fields[0]) {
+		return nil, chunkHeader{}, errors.New("invalid chunk header")
+	}
+	count, err := strconv.Atoi(fields[1])
+	if err != nil || count < 1 || count > maxChunks {
+		return nil, chunkHeader{}, errors.New("invalid chunk count")
+	}
+	length, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, chunkHeader{}, errors.New("invalid chunk length")
+	}
+	checksum, err := strconv.ParseUint(fields[3], 16, 32)
+	if err != nil {
+		return nil, chunkHeader{}, errors.New("invalid chunk checksum")
+	}
+
+	var builder strings.Builder
+	builder.WriteString(first[(separatorIndex + len(chunkHeaderSeparator)):])
+	for i := 1; i < count; i++ {
+		chunk, err := readChunk(i)
+		if err != nil {
+			return nil, chunkHeader{}, err
+		}
+		builder.WriteString(chunk)
+	}
+	data := []byte(builder.String())
+	if len(data) != length {
+		return nil, chunkHeader{}, fmt.Errorf("chunk length mismatch (expected %d, actual %d)", length, len(data))
+	}
+	if crc32.ChecksumIEEE(data) != uint32(checksum) {
+		return nil, chunkHeader{}, errors.New("chunk checksum mismatch")
+	}
+	return data, chunkHeader{version: fields[0], sessionID: fields[4]}, nil
+}
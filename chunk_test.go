@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// chunkReader はencodeChunksの結果をdecodeChunksに渡すためのreadChunk
+func chunkReader(chunks []string) func(index int) (string, error) {
+	return func(index int) (string, error) {
+		if index >= len(chunks) {
+			return "", nil
+		}
+		return chunks[index], nil
+	}
+}
+
+func TestChunksRoundTrip(t *testing.T) {
+	header := chunkHeader{version: descriptionEncodingCompact, sessionID: "0123456789abcdef"}
+	tests := []struct {
+		name     string
+		dataLen  int
+		wantLen  int
+		maxChunk int
+	}{
+		{name: "empty", dataLen: 0, wantLen: 1, maxChunk: 4},
+		{name: "single", dataLen: 10, wantLen: 1, maxChunk: 4},
+		// ヘッダ(33バイト)と合わせてちょうどチャンクサイズになる場合
+		{name: "exact chunk size", dataLen: 67, wantLen: 1, maxChunk: 4},
+		{name: "one byte over chunk size", dataLen: 68, wantLen: 2, maxChunk: 4},
+		{name: "multiple", dataLen: 250, wantLen: 3, maxChunk: 4},
+		// ヘッダ(34バイト)と合わせてちょうど最大チャンク数になる場合
+		{name: "max chunks", dataLen: 366, wantLen: 4, maxChunk: 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := []byte(strings.Repeat("x", test.dataLen))
+			chunks, err := encodeChunks(data, header, 100, test.maxChunk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chunks) != test.wantLen {
+				t.Fatalf("len(chunks) = %d, want %d", len(chunks), test.wantLen)
+			}
+			for i, chunk := range chunks {
+				if len(chunk) > 100 {
+					t.Fatalf("chunk %d is %d bytes", i, len(chunk))
+				}
+			}
+			decoded, decodedHeader, err := decodeChunks(chunkReader(chunks), test.maxChunk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(decoded) != string(data) {
+				t.Fatalf("decoded %d bytes, want %d", len(decoded), len(data))
+			}
+			if decodedHeader != header {
+				t.Fatalf("header = %+v, want %+v", decodedHeader, header)
+			}
+		})
+	}
+}
+
+func TestEncodeChunksTooLarge(t *testing.T) {
+	_, err := encodeChunks([]byte(strings.Repeat("x", 1000)), chunkHeader{version: descriptionEncodingJSON}, 100, 4)
+	if err == nil {
+		t.Fatal("want error for data exceeding max chunks")
+	}
+}
+
+func TestDecodeChunksErrors(t *testing.T) {
+	data := []byte(strings.Repeat("0123456789", 25))
+	header := chunkHeader{version: descriptionEncodingJSON, sessionID: "session"}
+	chunks, err := encodeChunks(data, header, 100, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherChunks, err := encodeChunks([]byte(strings.Repeat("abcdefghij", 25)), chunkHeader{version: descriptionEncodingJSON, sessionID: "another"}, 100, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaceHeader := func(header string) []string {
+		first := chunks[0][strings.Index(chunks[0], chunkHeaderSeparator):]
+		return append([]string{header + first}, chunks[1:]...)
+	}
+	checksum := strings.Split(chunks[0], ":")[3]
+	tests := []struct {
+		name    string
+		chunks  []string
+		read    func(index int) (string, error)
+		wantErr string
+	}{
+		{name: "empty", chunks: []string{""}, wantErr: "chunk header not found"},
+		{name: "no separator", chunks: []string{"1:1:0:00000000:session"}, wantErr: "chunk header not found"},
+		{name: "field count", chunks: replaceHeader("1:3:250:" + checksum), wantErr: "invalid chunk header"},
+		{name: "unknown version", chunks: replaceHeader("9:3:250:" + checksum + ":session"), wantErr: "invalid chunk header"},
+		{name: "zero count", chunks: replaceHeader("1:0:250:" + checksum + ":session"), wantErr: "invalid chunk count"},
+		{name: "count over max", chunks: replaceHeader("1:5:250:" + checksum + ":session"), wantErr: "invalid chunk count"},
+		{name: "count too small", chunks: replaceHeader("1:2:250:" + checksum + ":session"), wantErr: "chunk length mismatch"},
+		{name: "missing chunk", chunks: chunks[:2], wantErr: "chunk length mismatch"},
+		{name: "invalid length", chunks: replaceHeader("1:3:abc:" + checksum + ":session"), wantErr: "invalid chunk length"},
+		{name: "length mismatch", chunks: replaceHeader("1:3:249:" + checksum + ":session"), wantErr: "chunk length mismatch"},
+		{name: "invalid checksum", chunks: replaceHeader("1:3:250:xyz:session"), wantErr: "invalid chunk checksum"},
+		{name: "checksum mismatch", chunks: replaceHeader("1:3:250:00000000:session"), wantErr: "chunk checksum mismatch"},
+		{name: "chunks from another session", chunks: []string{chunks[0], otherChunks[1], otherChunks[2]}, wantErr: "chunk checksum mismatch"},
+		{
+			name: "read error",
+			read: func(index int) (string, error) {
+				if index == 0 {
+					return chunks[0], nil
+				}
+				return "", errors.New("read error")
+			},
+			wantErr: "read error",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			read := test.read
+			if read == nil {
+				read = chunkReader(test.chunks)
+			}
+			_, _, err := decodeChunks(read, 4)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("err = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeChunksSessionID(t *testing.T) {
+	for _, sessionID := range []string{"", "a", "0123456789abcdef"} {
+		chunks, err := encodeChunks([]byte("data"), chunkHeader{version: descriptionEncodingJSON, sessionID: sessionID}, 100, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, header, err := decodeChunks(chunkReader(chunks), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.sessionID != sessionID {
+			t.Errorf("sessionID = %q, want %q", header.sessionID, sessionID)
+		}
+	}
+}
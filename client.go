@@ -2,16 +2,14 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"net/http"
+	"io/ioutil"
 	"os"
 	"os/signal"
-	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
@@ -19,330 +17,388 @@ import (
 	"golang.org/x/crypto/ssh/terminal"
 )
 
-type soracomCredential struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+// clientOptions はクライアントモードでのみ使用する設定
+type clientOptions struct {
+	// commandを指定した場合はPTYを使わずにコマンドを実行する
+	command        []string
+	localForwards  portForwardFlags
+	remoteForwards portForwardFlags
+	// SOCKS5サーバーとして待ち受けるアドレス
+	dynamicForwards dynamicForwardFlags
+	// SFTPのために待ち受けるアドレス
+	sftpListen string
 }
 
-type soracomToken struct {
-	ApiKey     string `json:"apiKey"`
-	OperatorId string `json:"operatorId"`
-	Token      string `json:"token"`
-}
+// runClientMode はリモートのシェルの終了コードを返す
+func runClientMode(selector *deviceSelector, client *soracomClient, config *sessionConfig, options *clientOptions) (int, error) {
+	command := options.command
+	// 標準入力か標準出力が端末でない場合はPTYを使わずにログインシェルを実行する
+	if len(command) == 0 && !(terminal.IsTerminal(int(os.Stdin.Fd())) && terminal.IsTerminal(int(os.Stdout.Fd()))) {
+		command = loginShellCommand
+	}
+	openCh := make(chan bool)
+	done := newSessionDone()
+	trickleCtx, cancelTrickle := context.WithTimeout(context.Background(), config.signalingTimeout)
+	defer cancelTrickle()
+	peerConnection, err := connectDevice(trickleCtx, selector, client, config, done, func(peerConnection *webrtc.PeerConnection) {
+		setupClientDataChannel(peerConnection, openCh, done, config.signalingTimeout, command, options.remoteForwards)
+	})
+	if err != nil {
+		return 0, err
+	}
+	err = waitDataChannelOpen(openCh, done, config.signalingTimeout)
+	if err != nil {
+		return 0, err
+	}
+	for _, forward := range options.localForwards {
+		err = startLocalForward(peerConnection, forward)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	for _, listenAddress := range options.dynamicForwards {
+		err = startDynamicForward(peerConnection, listenAddress)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if options.sftpListen != "" {
+		err = startSFTPListener(peerConnection, options.sftpListen)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
 
-type inventoryDevice struct {
-	DeviceId string `json:"deviceId"`
-	Endpoint string `json:"endpoint"`
-}
+	// コマンドの実行時はシグナルをリモートのプロセスに転送し、終了を待つ
+	if len(command) > 0 {
+		<-done.done()
+		return done.exitCode, nil
+	}
 
-type inventoryResourceInteger struct {
-	Id    int    `json:"id"`
-	Type  string `json:"type"`
-	Value int    `json:"value"`
-}
+	oldState, _ := terminal.MakeRaw((int)(os.Stdin.Fd()))
+	defer func() { _ = terminal.Restore(int(os.Stdin.Fd()), oldState) }()
 
-type inventoryResourceString struct {
-	Id    int    `json:"id"`
-	Type  string `json:"type"`
-	Value string `json:"value"`
-}
+	trapSignals := []os.Signal{
+		syscall.SIGINT,
+		syscall.SIGTERM,
+		syscall.SIGQUIT}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, trapSignals...)
+	select {
+	case <-sigCh:
+		return sessionFailedExitCode, nil
+	case <-done.done():
+		return done.exitCode, nil
+	}
 
-type valueJson struct {
-	Value string `json:"value"`
 }
 
-func runClientMode(endpoint string) error {
-	peerConnection, err := createPeerConnection()
-	if err != nil {
-		return err
-	}
-	openCh := make(chan bool)
-	errCh := make(chan bool)
-	setupClientDataChannel(peerConnection, openCh, errCh)
-	email := getInput("Input Soracom account email: ")
-	password := getPasswordInput("Input Soracom account password: ")
-
-	fmt.Print("SORACOM認証中...")
-	token, err := getSoracomToken(email, password)
+// connectDevice はデバイスを選択してシグナリングを行い、WebRTCの接続を開始する
+// setupはシグナリングの前にデータチャネルの受け付けを設定するために呼ぶ
+// ICE候補の交換はtrickleCtxが終了するまで続け、WebRTCの接続に失敗した場合はdoneを失敗として終了する
+func connectDevice(trickleCtx context.Context, selector *deviceSelector, client *soracomClient, config *sessionConfig, done *sessionDone, setup func(*webrtc.PeerConnection)) (*webrtc.PeerConnection, error) {
+	peerConnection, err := createPeerConnection(config.ice)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	fmt.Println("完了")
-	fmt.Print("デバイス取得中...")
-	device, err := getDevice(endpoint, token)
+	setup(peerConnection)
+	err = loginSoracom(client)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	fmt.Println("完了")
-	err = startSignaling(token, device)
+	fmt.Fprint(os.Stderr, "デバイス取得中...")
+	device, err := selectDevice(client, selector)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	fmt.Print("Offer受信中...")
-	err = waitRecvOffer(token, device)
+	fmt.Fprintf(os.Stderr, "完了(%s)\n", device.DeviceId)
+	sig := newInventorySignaler(&apiResourceStore{client: client, device: device})
+	trickle := newTrickleICE(peerConnection, sig, done.fail)
+	err = sig.startSignaling()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = recvOffer(peerConnection, token, device)
+	fmt.Fprint(os.Stderr, "Offer受信中...")
+	offerCtx, cancelOffer := context.WithTimeout(context.Background(), config.signalingTimeout)
+	defer cancelOffer()
+	err = recvOffer(offerCtx, peerConnection, sig)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	fmt.Println("完了")
-	fmt.Print("Answer送信中...")
-	err = sendAnswer(peerConnection, token, device)
+	trickle.startReceiving(trickleCtx, peerConnection)
+	fmt.Fprintln(os.Stderr, "完了")
+	fmt.Fprint(os.Stderr, "Answer送信中...")
+	err = sendAnswer(peerConnection, sig)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = waitFinishSignaling(token, device)
+	trickle.startPublishing(trickleCtx)
+	answerCtx, cancelAnswer := context.WithTimeout(context.Background(), config.signalingTimeout)
+	defer cancelAnswer()
+	err = sig.awaitStatus(answerCtx, signalingStatusAnswered, signalingStatusConnected)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return peerConnection, nil
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+// waitDataChannelOpen はopenChに通知されるまでtimeoutだけ待つ
+// 待っている間に接続が切れてセッションが終了した場合はエラーを返す
+func waitDataChannelOpen(openCh chan bool, done *sessionDone, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 	select {
 	case <-ctx.Done():
 		return errors.New("timeout wait open webRTC data channel")
+	case <-done.done():
+		return errors.New("connection closed before webRTC data channel opened")
 	case <-openCh:
-	}
-
-	oldState, _ := terminal.MakeRaw((int)(os.Stdin.Fd()))
-	defer func() { _ = terminal.Restore(int(os.Stdin.Fd()), oldState) }()
-
-	trapSignals := []os.Signal{
-		syscall.SIGINT,
-		syscall.SIGTERM,
-		syscall.SIGQUIT}
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, trapSignals...)
-	select {
-	case <-sigCh:
-		return nil
-	case <-errCh:
 		return nil
 	}
-
 }
 
-func setupClientDataChannel(peerConnection *webrtc.PeerConnection, openCh, errCh chan bool) {
+func setupClientDataChannel(peerConnection *webrtc.PeerConnection, openCh chan bool, done *sessionDone, signalingTimeout time.Duration, command []string, remoteForwards portForwardFlags) {
+	var control *controlChannel
+	controlOpenCh := make(chan struct{})
+	// デバイス側はexitの前に出力のデータチャネルを閉じる
+	outputClosed := newOutputClosed()
+	// 対話セッションの場合のみエスケープを受け付ける
+	var escape *escapeHandler
+	if len(command) == 0 {
+		escape = newEscapeHandler(peerConnection, done, signalingTimeout)
+	}
 	peerConnection.OnDataChannel(func(dataChannel *webrtc.DataChannel) {
-		keepAliveCh := make(chan bool)
-		finishCh := make(chan bool)
-		dataChannel.OnOpen(func() {
+		switch dataChannel.Label() {
+		case dataChannelLabel:
+			stream := newBridgeStream(dataChannel)
+			setupClientStreamChannel(dataChannel, stream, openCh, escape)
+			receiveOutput(dataChannel, stream, os.Stdout, outputClosed.closeData)
+		case stderrChannelLabel:
+			receiveOutput(dataChannel, newBridgeStream(dataChannel), os.Stderr, outputClosed.closeStderr)
+		case controlChannelLabel:
+			control = newControlChannel(dataChannel)
+			setupClientControlChannel(control, dataChannel, controlOpenCh, done, command, remoteForwards, outputClosed)
+		default:
+			acceptReverseForwardChannel(dataChannel, remoteForwards)
+		}
+	})
+}
 
-			openCh <- true
-			go func() {
-				t := time.NewTicker(5 * time.Second)
-				defer t.Stop()
-				for {
-					select {
-					case <-finishCh:
-						return
-					case <-t.C:
-						dataChannel.SendText("Keep Alive")
-					}
+// setupClientStreamChannel は標準入力をデータチャネルに送信する
+// 標準入力が終端に達した場合は入力と同じデータチャネルで終端を通知し、以降は送信しない
+// escapeを指定した場合はエスケープを処理してから送信する
+func setupClientStreamChannel(dataChannel *webrtc.DataChannel, stream *bridgeStream, openCh chan bool, escape *escapeHandler) {
+	dataChannel.OnOpen(func() {
+		openCh <- true
+		buf := make([]byte, 1024)
+		for {
+			readLen, err := os.Stdin.Read(buf)
+			if err != nil {
+				if err == io.EOF {
+					stream.closeWrite()
 				}
-			}()
-
-			go func() {
-				for {
-					ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-					defer cancel()
-					select {
-					case <-ctx.Done():
-						finishCh <- true
-						errCh <- true
-					case <-keepAliveCh:
+				return
+			} else {
+				input := buf[:readLen]
+				if escape != nil {
+					input = escape.filter(input)
+					if len(input) == 0 {
+						continue
 					}
 				}
-			}()
-
-			buf := make([]byte, 1024)
-			for {
-				readLen, err := os.Stdin.Read(buf)
+				_, err = stream.Write(input)
 				if err != nil {
-					if err == io.EOF {
-						continue
-					}
+					fmt.Fprintln(os.Stderr, err)
 					return
-				} else {
-					err = dataChannel.Send(buf[:readLen])
-					if err != nil {
-						fmt.Fprintln(os.Stderr, err)
-						return
-					}
-				}
-			}
-		})
-		dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
-			if msg.IsString {
-				if string(msg.Data) == "terminate" {
-					finishCh <- true
-					errCh <- true
 				}
-				keepAliveCh <- true
-			} else {
-				out := bufio.NewWriter(os.Stdout)
-				out.Write(msg.Data)
-				out.Flush()
 			}
-		})
+		}
 	})
 }
 
-func getInput(inst string) string {
-	for {
-		fmt.Print(inst)
-		scanner := bufio.NewScanner(os.Stdin)
-		done := scanner.Scan()
-		if done {
-			input := scanner.Text()
-			if input != "" {
-				return input
-			}
+// receiveOutput はデバイス側の出力をwに書き込む
+// 書き込みを待つ間もデータチャネルの受信を止めないように、受信した出力はstreamのキューを介して別のgoroutineで書き込む
+// データチャネルが閉じ、受信済みの出力をすべて書き込んだ後にonDoneを呼ぶ
+func receiveOutput(dataChannel *webrtc.DataChannel, stream *bridgeStream, w io.Writer, onDone func()) {
+	dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		_, err := stream.receive(msg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			stream.close()
+			dataChannel.Close()
 		}
-	}
+	})
+	dataChannel.OnClose(stream.close)
+	go func() {
+		err := stream.copyTo(w)
+		if err != nil {
+			// 書き込めなくなった後もデバイス側の送信を止めないように、残りの出力は捨ててackを返す
+			stream.copyTo(ioutil.Discard)
+		}
+		onDone()
+	}()
 }
 
-func getPasswordInput(inst string) string {
-	for {
-		fmt.Print(inst)
-		password, err := terminal.ReadPassword(int(syscall.Stdin))
-		if err != nil {
-			continue
-		} else {
-			if string(password) != "" {
-				fmt.Println("")
-				return string(password)
-			}
+// outputClosed はデバイス側の出力のデータチャネル(dataとstderr)が閉じたことを通知する
+type outputClosed struct {
+	dataCh     chan struct{}
+	stderrCh   chan struct{}
+	dataOnce   sync.Once
+	stderrOnce sync.Once
+}
+
+func newOutputClosed() *outputClosed {
+	return &outputClosed{dataCh: make(chan struct{}), stderrCh: make(chan struct{})}
+}
+
+func (o *outputClosed) closeData() {
+	o.dataOnce.Do(func() { close(o.dataCh) })
+}
+
+func (o *outputClosed) closeStderr() {
+	o.stderrOnce.Do(func() { close(o.stderrCh) })
+}
+
+// wait は出力のデータチャネルが両方閉じるまで待つ
+// 以前のバージョンのデバイスなど、閉じない場合に備えて一定時間で諦める
+func (o *outputClosed) wait() {
+	timeout := time.After(5 * time.Second)
+	for _, ch := range []chan struct{}{o.dataCh, o.stderrCh} {
+		select {
+		case <-ch:
+		case <-timeout:
+			return
 		}
 	}
 }
 
-func requestHttp(method, url string, data interface{}, token *soracomToken) ([]byte, error) {
-	var req *http.Request
-	var err error
-	if data != nil {
-		payloadBytes, err := json.Marshal(data)
-		if err != nil {
-			return nil, errors.New("fail to serialize data")
+// setupClientControlChannel は実行するコマンドと端末サイズの通知、keepalive、終了の通知を扱う
+// exitを受信した場合は出力をすべて受信してから終了する
+func setupClientControlChannel(control *controlChannel, dataChannel *webrtc.DataChannel, controlOpenCh chan struct{}, done *sessionDone, command []string, remoteForwards portForwardFlags, outputClosed *outputClosed) {
+	dataChannel.OnOpen(func() {
+		control.sendHello()
+		control.startKeepAlive(done.fail)
+		defer close(controlOpenCh)
+		for _, forward := range remoteForwards {
+			control.send(&controlMessage{Type: controlTypeListen, Address: forward.listenAddress})
 		}
-		body := bytes.NewReader(payloadBytes)
-		req, err = http.NewRequest(method, url, body)
-		if err != nil {
-			return nil, errors.New("fail to create http request")
+		if len(command) > 0 {
+			control.send(&controlMessage{Type: controlTypeExec, Command: command})
+			go forwardSignals(control)
+			return
 		}
-		req.Header.Set("Content-Type", "application/json")
-	} else {
-		req, err = http.NewRequest(method, url, nil)
+		// 端末サイズを通知し、以降はサイズが変わるたびに通知する
+		sendWindowSize(control)
+		control.send(&controlMessage{Type: controlTypeExec})
+		go func() {
+			winchCh := make(chan os.Signal, 1)
+			signal.Notify(winchCh, syscall.SIGWINCH)
+			for range winchCh {
+				sendWindowSize(control)
+			}
+		}()
+	})
+	dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		message, err := control.receive(msg)
 		if err != nil {
-			return nil, errors.New("fail to create http request")
+			control.sendError(err.Error())
+			return
 		}
-	}
-	req.Header.Set("Accept", "application/json")
-	if token != nil {
-		req.Header.Set("X-Soracom-Api-Key", token.ApiKey)
-		req.Header.Set("X-Soracom-Token", token.Token)
-	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, errors.New("fail to access via http")
-	}
-	defer resp.Body.Close()
+		switch message.Type {
+		case controlTypeHello:
+			err = control.checkHello(message)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				done.fail()
+			}
+		case controlTypeListenError:
+			fmt.Fprintln(os.Stderr, message.Message)
+		case controlTypeExit:
+			control.close()
+			go func() {
+				outputClosed.wait()
+				done.exit(message.ExitCode)
+			}()
+		case controlTypeError:
+			fmt.Fprintln(os.Stderr, message.Message)
+			control.close()
+			done.fail()
+		}
+	})
+}
 
-	buf := make([]byte, 65536)
-	readLen, err := resp.Body.Read(buf)
-	if err != nil && err.Error() != "EOF" {
-		return nil, errors.New("fail to read http body")
-	}
-	if resp.StatusCode < 300 {
-		return buf[:readLen], nil
-	} else {
-		return nil, errors.New("fail to request API\n" + string(buf[:readLen]))
+// forwardSignals は受信したシグナルをリモートのプロセスに転送する
+func forwardSignals(control *controlChannel) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	for sig := range sigCh {
+		for name, signal := range signalNames {
+			if signal == sig {
+				control.send(&controlMessage{Type: controlTypeSignal, Signal: name})
+			}
+		}
 	}
 }
 
-func getSoracomToken(email, password string) (*soracomToken, error) {
-	data := soracomCredential{Email: email, Password: password}
-	buf, err := requestHttp("POST", "https://api.soracom.io/v1/auth", data, nil)
-	if err != nil {
-		return nil, err
-	}
-	var token = &soracomToken{}
-	err = json.Unmarshal(buf, token)
+func sendWindowSize(control *controlChannel) {
+	width, height, err := terminal.GetSize(int(os.Stdout.Fd()))
 	if err != nil {
-		return nil, errors.New("fail to parse token")
+		return
 	}
-	return token, nil
+	control.send(&controlMessage{Type: controlTypeResize, Cols: uint16(width), Rows: uint16(height)})
 }
 
-func getDevice(endpoint string, token *soracomToken) (*inventoryDevice, error) {
-	buf, err := requestHttp("GET", "https://api.soracom.io/v1/devices", nil, token)
-	if err != nil {
-		return nil, err
+// loginSoracom はキャッシュ済みのトークンが無ければ認証を行う
+func loginSoracom(client *soracomClient) error {
+	if client.loadCachedToken() {
+		return nil
 	}
-	var devices []inventoryDevice
-	err = json.Unmarshal(buf, &devices)
+	credential, err := client.credentialFunc()
 	if err != nil {
-		return nil, errors.New("fail to parse devices")
-	}
-	for _, device := range devices {
-		if device.Endpoint == endpoint {
-			return &device, nil
-		}
+		return err
 	}
-	return nil, errors.New("device not found")
-}
-
-func startSignaling(token *soracomToken, device *inventoryDevice) error {
-	_, err := requestHttp("POST", "https://api.soracom.io/v1/devices/"+device.DeviceId+"/9/0/4/execute", nil, token)
+	fmt.Fprint(os.Stderr, "SORACOM認証中...")
+	err = client.auth(credential)
 	if err != nil {
 		return err
 	}
+	fmt.Fprintln(os.Stderr, "完了")
 	return nil
 }
 
-func waitRecvOffer(token *soracomToken, device *inventoryDevice) error {
-	for i := 0; i < 60; i++ {
-		time.Sleep(1 * time.Second)
-		status, err := checkSignalingStatus(token, device)
-		if err == nil && status == 1 {
-			return nil
+func getInput(inst string) string {
+	for {
+		fmt.Fprint(os.Stderr, inst)
+		scanner := bufio.NewScanner(os.Stdin)
+		done := scanner.Scan()
+		if done {
+			input := scanner.Text()
+			if input != "" {
+				return input
+			}
 		}
 	}
-	return errors.New("timeout wait signaling")
 }
 
-func checkSignalingStatus(token *soracomToken, device *inventoryDevice) (int, error) {
-	buf, err := requestHttp("GET", "https://api.soracom.io/v1/devices/"+device.DeviceId+"/9/0/7?model=false", nil, token)
-	if err != nil {
-		return 0, err
-	}
-	var status = &inventoryResourceInteger{}
-	err = json.Unmarshal(buf, status)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "fail to parse status")
-		os.Exit(1)
-	}
-	return status.Value, nil
-}
-
-func recvOffer(peerConnection *webrtc.PeerConnection, token *soracomToken, device *inventoryDevice) error {
-	offerDescriptionString := ""
-	for i := 0; i < 4; i++ {
-		description, err := readOfferDescription(token, device, i)
+func getPasswordInput(inst string) string {
+	for {
+		fmt.Fprint(os.Stderr, inst)
+		password, err := terminal.ReadPassword(int(syscall.Stdin))
 		if err != nil {
-			return err
-		}
-		offerDescriptionString = offerDescriptionString + description
-		if len(description) < 800 {
-			break
+			continue
+		} else {
+			if string(password) != "" {
+				fmt.Fprintln(os.Stderr, "")
+				return string(password)
+			}
 		}
 	}
-	var offer webrtc.SessionDescription
-	err := json.Unmarshal([]byte(offerDescriptionString), &offer)
+}
+
+func recvOffer(ctx context.Context, peerConnection *webrtc.PeerConnection, sig signaler) error {
+	offer, err := sig.awaitOffer(ctx)
 	if err != nil {
-		return errors.New("fail to parse offer")
+		return err
 	}
 	err = peerConnection.SetRemoteDescription(offer)
 	if err != nil {
@@ -351,20 +407,7 @@ func recvOffer(peerConnection *webrtc.PeerConnection, token *soracomToken, devic
 	return nil
 }
 
-func readOfferDescription(token *soracomToken, device *inventoryDevice, instanceID int) (string, error) {
-	buf, err := requestHttp("GET", "https://api.soracom.io/v1/devices/"+device.DeviceId+"/9/"+strconv.Itoa(instanceID)+"/0?model=false", nil, token)
-	if err != nil {
-		return "", err
-	}
-	var description = &inventoryResourceString{}
-	err = json.Unmarshal(buf, description)
-	if err != nil {
-		return "", errors.New("fail to parse offer description")
-	}
-	return description.Value, nil
-}
-
-func sendAnswer(peerConnection *webrtc.PeerConnection, token *soracomToken, device *inventoryDevice) error {
+func sendAnswer(peerConnection *webrtc.PeerConnection, sig signaler) error {
 	answer, err := peerConnection.CreateAnswer(nil)
 	if err != nil {
 		return errors.New("fail to create answer")
@@ -373,53 +416,23 @@ func sendAnswer(peerConnection *webrtc.PeerConnection, token *soracomToken, devi
 	if err != nil {
 		return errors.New("fail to set client local description")
 	}
-	answerDescriptionBytes, err := json.Marshal(answer)
-	if err != nil {
-		return errors.New("fail to serialize answer description")
-	}
-	for i := 0; i < 4; i++ {
-		if len(answerDescriptionBytes) < (i+1)*800 {
-			err := writeAnswerDescription(token, device, i, string(answerDescriptionBytes[(i*800):]))
-			if err != nil {
-				return err
-			}
-			break
-		} else {
-			err := writeAnswerDescription(token, device, i, string(answerDescriptionBytes[(i*800):((i+1)*800)]))
-			if err != nil {
-				return err
-			}
-		}
-	}
-	notifySendDescription(token, device)
-	return nil
+	return sig.publishAnswer(answer)
 }
 
-func writeAnswerDescription(token *soracomToken, device *inventoryDevice, instanceID int, description string) error {
-	value := &valueJson{Value: description}
-	_, err := requestHttp("PUT", "https://api.soracom.io/v1/devices/"+device.DeviceId+"/9/"+strconv.Itoa(instanceID)+"/3", value, token)
-	if err != nil {
-		return err
-	}
-	return nil
+// apiResourceStore はSORACOM API経由でデバイスのリソースを読み書きする
+type apiResourceStore struct {
+	client *soracomClient
+	device *inventoryDevice
 }
 
-func notifySendDescription(token *soracomToken, device *inventoryDevice) error {
-	value := &valueJson{Value: "done"}
-	_, err := requestHttp("PUT", "https://api.soracom.io/v1/devices/"+device.DeviceId+"/9/0/14", value, token)
-	if err != nil {
-		return err
-	}
-	return nil
+func (s *apiResourceStore) readResource(instanceID, resourceID int) (string, error) {
+	return s.client.readResource(s.device.DeviceId, 9, instanceID, resourceID)
 }
 
-func waitFinishSignaling(token *soracomToken, device *inventoryDevice) error {
-	for i := 0; i < 60; i++ {
-		time.Sleep(1 * time.Second)
-		status, err := checkSignalingStatus(token, device)
-		if err == nil && status == 2 {
-			return nil
-		}
-	}
-	return errors.New("timeout to wait finish signaling")
+func (s *apiResourceStore) writeResource(instanceID, resourceID int, value string) error {
+	return s.client.writeResource(s.device.DeviceId, 9, instanceID, resourceID, value)
+}
+
+func (s *apiResourceStore) executeResource(instanceID, resourceID int) error {
+	return s.client.executeResource(s.device.DeviceId, 9, instanceID, resourceID)
 }
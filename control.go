@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pion/webrtc"
+)
+
+// データチャネルのラベル
+// dataは入出力のバイト列、stderrはコマンドの標準エラー出力のみ、controlは制御メッセージのみを送受信する
+const (
+	dataChannelLabel    = "data"
+	stderrChannelLabel  = "stderr"
+	controlChannelLabel = "control"
+)
+
+// 制御メッセージのプロトコルバージョン
+// helloで交換し、一致しない場合は接続を終了する
+// 下記のデータチャネルのテキストのメッセージもこのバージョンに含み、変更する場合はバージョンを上げる
+// バージョン5から入出力のデータチャネルでもポート転送と同じackによるフロー制御を行う
+// バージョン6から接続の失敗の通知に詳細を含める
+const controlProtocolVersion = 6
+
+// data、stderr、ポート転送、SFTPのデータチャネルで送受信するテキストのメッセージ
+// バイト列はバイナリのメッセージで送信し、テキストのメッセージは以下のみを使用する
+//   - "ack:<バイト数>" : 受信側が書き込んだバイト数
+//   - "eof" : 送信側の入力の終端(dataチャネルではPC側の標準入力の終端)
+//     バイト列と同じデータチャネルで送るため、受信側はそれまでのバイト列をすべて書き込んでから終端を処理する
+//   - "connected"、"error:<種類>:<詳細>" : ポート転送とSFTPで接続先に接続した側が、データチャネルが開いた後に最初に送る接続の結果
+//     失敗した場合は"error:<種類>:<詳細>"を送信してデータチャネルを閉じる。詳細は相手側で表示するエラーのメッセージ
+const (
+	bridgeAckPrefix        = "ack:"
+	bridgeEOFMessage       = "eof"
+	bridgeConnectedMessage = "connected"
+	bridgeErrorPrefix      = "error:"
+)
+
+// 制御メッセージの種類
+const (
+	controlTypeHello       = "hello"
+	controlTypeExec        = "exec"
+	controlTypeListen      = "listen"
+	controlTypeListenError = "listen-error"
+	controlTypeResize      = "resize"
+	controlTypeSignal      = "signal"
+	controlTypeExit        = "exit"
+	controlTypeKeepAlive   = "keepalive"
+	controlTypeError       = "error"
+)
+
+const (
+	keepAliveInterval time.Duration = 5 * time.Second
+	keepAliveTimeout  time.Duration = 15 * time.Second
+)
+
+// controlMessage は制御チャネルで送受信するメッセージ
+// 1メッセージを1つのJSONテキストとしてデータチャネルで送信する
+type controlMessage struct {
+	Type     string   `json:"type"`
+	Version  int      `json:"version,omitempty"`
+	Command  []string `json:"command,omitempty"`
+	Cols     uint16   `json:"cols,omitempty"`
+	Rows     uint16   `json:"rows,omitempty"`
+	Signal   string   `json:"signal,omitempty"`
+	Address  string   `json:"address,omitempty"`
+	ExitCode int      `json:"exitCode"`
+	Message  string   `json:"message,omitempty"`
+}
+
+// signalNames はsignalメッセージで送受信できるシグナル
+var signalNames = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+}
+
+// controlSender は制御メッセージを送信するデータチャネル
+type controlSender interface {
+	SendText(s string) error
+}
+
+// controlChannel は制御メッセージの送受信とkeepaliveを行う
+type controlChannel struct {
+	dataChannel       controlSender
+	mu                sync.Mutex
+	receivedCh        chan struct{}
+	doneCh            chan struct{}
+	closeOnce         sync.Once
+	keepAliveInterval time.Duration
+	keepAliveTimeout  time.Duration
+}
+
+func newControlChannel(dataChannel controlSender) *controlChannel {
+	return &controlChannel{
+		dataChannel:       dataChannel,
+		receivedCh:        make(chan struct{}, 1),
+		doneCh:            make(chan struct{}),
+		keepAliveInterval: keepAliveInterval,
+		keepAliveTimeout:  keepAliveTimeout,
+	}
+}
+
+func (c *controlChannel) send(message *controlMessage) error {
+	messageBytes, err := json.Marshal(message)
+	if err != nil {
+		return errors.New("fail to serialize control message")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dataChannel.SendText(string(messageBytes))
+}
+
+func (c *controlChannel) sendHello() error {
+	return c.send(&controlMessage{Type: controlTypeHello, Version: controlProtocolVersion})
+}
+
+func (c *controlChannel) sendError(message string) error {
+	return c.send(&controlMessage{Type: controlTypeError, Message: message})
+}
+
+// receive は受信したメッセージを解析する
+// 制御メッセージ以外を受信した場合はエラーを返す
+func (c *controlChannel) receive(msg webrtc.DataChannelMessage) (*controlMessage, error) {
+	select {
+	case c.receivedCh <- struct{}{}:
+	default:
+	}
+	if !msg.IsString {
+		return nil, errors.New("unexpected binary control message")
+	}
+	var message controlMessage
+	err := json.Unmarshal(msg.Data, &message)
+	if err != nil || message.Type == "" {
+		return nil, errors.New("invalid control message")
+	}
+	return &message, nil
+}
+
+// checkHello は相手のhelloのバージョンを確認し、一致しなければ相手にエラーを通知する
+func (c *controlChannel) checkHello(message *controlMessage) error {
+	if message.Version == controlProtocolVersion {
+		return nil
+	}
+	reason := "unsupported control protocol version"
+	c.sendError(reason)
+	return errors.New(reason)
+}
+
+// startKeepAlive は一定間隔でkeepaliveを送信し、相手から一定時間メッセージが届かなければonTimeoutを呼ぶ
+func (c *controlChannel) startKeepAlive(onTimeout func()) {
+	go func() {
+		t := time.NewTicker(c.keepAliveInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-c.doneCh:
+				return
+			case <-t.C:
+				c.send(&controlMessage{Type: controlTypeKeepAlive})
+			}
+		}
+	}()
+
+	go func() {
+		timer := time.NewTimer(c.keepAliveTimeout)
+		defer timer.Stop()
+		for {
+			select {
+			case <-c.doneCh:
+				return
+			case <-timer.C:
+				onTimeout()
+				return
+			case <-c.receivedCh:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(c.keepAliveTimeout)
+			}
+		}
+	}()
+}
+
+func (c *controlChannel) close() {
+	c.closeOnce.Do(func() { close(c.doneCh) })
+}
+
+// sessionFailedExitCode はリモートのシェルの終了以外でセッションが終了した場合の終了コード
+// sshと同様に255とする
+const sessionFailedExitCode = 255
+
+// sessionDone はセッションの終了を一度だけ通知する
+// リモートのシェルが終了した場合はその終了コード、接続の切断やエラーの場合はsessionFailedExitCodeを保持する
+type sessionDone struct {
+	ch       chan struct{}
+	once     sync.Once
+	exitCode int
+}
+
+func newSessionDone() *sessionDone {
+	return &sessionDone{ch: make(chan struct{})}
+}
+
+func (d *sessionDone) finish() {
+	d.once.Do(func() { close(d.ch) })
+}
+
+// exit はリモートのシェルの終了コードを記録してセッションを終了する
+func (d *sessionDone) exit(exitCode int) {
+	d.once.Do(func() {
+		d.exitCode = exitCode
+		close(d.ch)
+	})
+}
+
+// fail はkeepaliveのタイムアウトやエラーなど、リモートのシェルの終了以外でセッションを終了する
+func (d *sessionDone) fail() {
+	d.exit(sessionFailedExitCode)
+}
+
+// failed はリモートのシェルの終了以外でセッションが終了したかを返す
+// done()が閉じた後に呼ぶ
+func (d *sessionDone) failed() bool {
+	return d.exitCode == sessionFailedExitCode
+}
+
+func (d *sessionDone) done() <-chan struct{} {
+	return d.ch
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc"
+)
+
+// fakeControlSender は送信したテキストを保持するcontrolSender
+type fakeControlSender struct {
+	mu   sync.Mutex
+	sent []string
+}
+
+func (s *fakeControlSender) SendText(text string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, text)
+	return nil
+}
+
+func (s *fakeControlSender) messages(t *testing.T) []controlMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	messages := []controlMessage{}
+	for _, text := range s.sent {
+		var message controlMessage
+		err := json.Unmarshal([]byte(text), &message)
+		if err != nil {
+			t.Fatalf("invalid sent message %q", text)
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+func TestControlChannelReceive(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      webrtc.DataChannelMessage
+		wantType string
+		wantErr  string
+	}{
+		{name: "hello", msg: webrtc.DataChannelMessage{IsString: true, Data: []byte(`{"type":"hello","version":6}`)}, wantType: controlTypeHello},
+		{name: "unknown type", msg: webrtc.DataChannelMessage{IsString: true, Data: []byte(`{"type":"unknown"}`)}, wantType: "unknown"},
+		{name: "binary", msg: webrtc.DataChannelMessage{Data: []byte(`{"type":"hello"}`)}, wantErr: "unexpected binary control message"},
+		{name: "malformed json", msg: webrtc.DataChannelMessage{IsString: true, Data: []byte(`{"type":`)}, wantErr: "invalid control message"},
+		{name: "missing type", msg: webrtc.DataChannelMessage{IsString: true, Data: []byte(`{"version":6}`)}, wantErr: "invalid control message"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			control := newControlChannel(&fakeControlSender{})
+			message, err := control.receive(test.msg)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("err = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if message.Type != test.wantType {
+				t.Fatalf("type = %q, want %q", message.Type, test.wantType)
+			}
+		})
+	}
+}
+
+// バージョンが一致しない場合は相手にエラーを通知する
+func TestControlChannelCheckHello(t *testing.T) {
+	tests := []struct {
+		name      string
+		version   int
+		wantError bool
+	}{
+		{name: "same version", version: controlProtocolVersion},
+		{name: "old version", version: controlProtocolVersion - 1, wantError: true},
+		{name: "no version", version: 0, wantError: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sender := &fakeControlSender{}
+			control := newControlChannel(sender)
+			err := control.checkHello(&controlMessage{Type: controlTypeHello, Version: test.version})
+			messages := sender.messages(t)
+			if !test.wantError {
+				if err != nil || len(messages) != 0 {
+					t.Fatalf("err = %v, sent = %v, want no error", err, messages)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("version mismatch is accepted")
+			}
+			if len(messages) != 1 || messages[0].Type != controlTypeError || messages[0].Message != err.Error() {
+				t.Fatalf("sent = %v, want error %q", messages, err.Error())
+			}
+		})
+	}
+}
+
+// 相手から一定時間メッセージが届かなければセッションを失敗として終了する
+func TestControlChannelKeepAliveTimeout(t *testing.T) {
+	sender := &fakeControlSender{}
+	control := newControlChannel(sender)
+	control.keepAliveInterval = 20 * time.Millisecond
+	control.keepAliveTimeout = 200 * time.Millisecond
+	defer control.close()
+	done := newSessionDone()
+	control.startKeepAlive(done.fail)
+
+	// メッセージを受信している間はタイムアウトしない
+	for i := 0; i < 6; i++ {
+		time.Sleep(50 * time.Millisecond)
+		control.receive(webrtc.DataChannelMessage{IsString: true, Data: []byte(`{"type":"keepalive"}`)})
+	}
+	select {
+	case <-done.done():
+		t.Fatal("session is finished while receiving messages")
+	default:
+	}
+
+	select {
+	case <-done.done():
+	case <-time.After(time.Second):
+		t.Fatal("session is not finished after keepalive timeout")
+	}
+	if !done.failed() {
+		t.Fatal("keepalive timeout is not a failure")
+	}
+	messages := sender.messages(t)
+	if len(messages) == 0 || messages[0].Type != controlTypeKeepAlive {
+		t.Fatalf("sent = %v, want keepalive", messages)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// soracomProfile はsoracom-cliのプロファイル(~/.soracom/<profile>.json)
+type soracomProfile struct {
+	CoverageType string `json:"coverageType"`
+	Email        string `json:"email"`
+	Password     string `json:"password"`
+	AuthKeyId    string `json:"authKeyId"`
+	AuthKey      string `json:"authKey"`
+	OperatorId   string `json:"operatorId"`
+	Username     string `json:"username"`
+	Endpoint     string `json:"endpoint"`
+}
+
+// soracomProfileDir はsoracom-cliと同様にSORACOM_PROFILE_DIRが設定されていればそれを、なければ~/.soracomを返す
+func soracomProfileDir() (string, error) {
+	dir := os.Getenv("SORACOM_PROFILE_DIR")
+	if dir != "" {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.New("fail to get home directory")
+	}
+	return filepath.Join(home, ".soracom"), nil
+}
+
+func loadSoracomProfile(name string) (*soracomProfile, error) {
+	dir, err := soracomProfileDir()
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(dir, name+".json"))
+	if err != nil {
+		return nil, errors.New("fail to read profile: " + name)
+	}
+	var profile = &soracomProfile{}
+	err = json.Unmarshal(buf, profile)
+	if err != nil {
+		return nil, errors.New("fail to parse profile: " + name)
+	}
+	return profile, nil
+}
+
+func (p *soracomProfile) credential() (*soracomCredential, error) {
+	switch {
+	case p.AuthKeyId != "" && p.AuthKey != "":
+		return &soracomCredential{AuthKeyId: p.AuthKeyId, AuthKey: p.AuthKey}, nil
+	case p.OperatorId != "" && p.Username != "" && p.Password != "":
+		return &soracomCredential{OperatorId: p.OperatorId, UserName: p.Username, Password: p.Password}, nil
+	case p.Email != "" && p.Password != "":
+		return &soracomCredential{Email: p.Email, Password: p.Password}, nil
+	}
+	return nil, errors.New("no credential in profile")
+}
+
+// credentialFromEnv は環境変数から認証情報を取得する
+// 該当する環境変数が設定されていない場合はnilを返す
+func credentialFromEnv() *soracomCredential {
+	authKeyId := os.Getenv("SORACOM_AUTH_KEY_ID")
+	authKey := os.Getenv("SORACOM_AUTH_KEY")
+	operatorId := os.Getenv("SORACOM_OPERATOR_ID")
+	userName := os.Getenv("SORACOM_USERNAME")
+	email := os.Getenv("SORACOM_EMAIL")
+	password := os.Getenv("SORACOM_PASSWORD")
+	switch {
+	case authKeyId != "" && authKey != "":
+		return &soracomCredential{AuthKeyId: authKeyId, AuthKey: authKey}
+	case operatorId != "" && userName != "" && password != "":
+		return &soracomCredential{OperatorId: operatorId, UserName: userName, Password: password}
+	case email != "" && password != "":
+		return &soracomCredential{Email: email, Password: password}
+	}
+	return nil
+}
+
+// getCredential はプロファイル、環境変数、対話入力の順に認証情報を取得する
+// 対話入力の場合、emailを指定していればパスワードのみ入力する
+func getCredential(profile *soracomProfile, email string) (*soracomCredential, error) {
+	if profile != nil {
+		return profile.credential()
+	}
+	credential := credentialFromEnv()
+	if credential != nil {
+		return credential, nil
+	}
+	// 標準入力をデータの転送に使用する場合などは対話入力できない
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, errors.New("credential is required: specify --profile or environment variables")
+	}
+	if email == "" {
+		email = getInput("Input Soracom account email: ")
+	}
+	password := getPasswordInput("Input Soracom account password: ")
+	return &soracomCredential{Email: email, Password: password}, nil
+}
+
+// credentialIdentity はパスワードを入力せずに分かる範囲で認証情報の識別子を返す
+// 対話入力の場合はメールアドレスのみ先に入力し、識別子と入力したメールアドレスを返す
+// 対話入力できない場合は空文字を返す
+func credentialIdentity(profile *soracomProfile) (string, string) {
+	if profile != nil {
+		credential, err := profile.credential()
+		if err != nil {
+			return "", ""
+		}
+		return credential.identity(), ""
+	}
+	credential := credentialFromEnv()
+	if credential != nil {
+		return credential.identity(), ""
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return "", ""
+	}
+	email := getInput("Input Soracom account email: ")
+	return (&soracomCredential{Email: email}).identity(), email
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// credentialEnvKeys は認証情報を取得する環境変数
+var credentialEnvKeys = []string{
+	"SORACOM_AUTH_KEY_ID", "SORACOM_AUTH_KEY", "SORACOM_OPERATOR_ID", "SORACOM_USERNAME", "SORACOM_EMAIL", "SORACOM_PASSWORD"}
+
+func TestCredentialFromEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want *soracomCredential
+	}{
+		{name: "none", env: map[string]string{}},
+		{
+			name: "auth key",
+			env:  map[string]string{"SORACOM_AUTH_KEY_ID": "keyId-1", "SORACOM_AUTH_KEY": "secret-1"},
+			want: &soracomCredential{AuthKeyId: "keyId-1", AuthKey: "secret-1"},
+		},
+		{
+			name: "sam user",
+			env:  map[string]string{"SORACOM_OPERATOR_ID": "OP1", "SORACOM_USERNAME": "user", "SORACOM_PASSWORD": "pass"},
+			want: &soracomCredential{OperatorId: "OP1", UserName: "user", Password: "pass"},
+		},
+		{
+			name: "root account",
+			env:  map[string]string{"SORACOM_EMAIL": "test@example.com", "SORACOM_PASSWORD": "pass"},
+			want: &soracomCredential{Email: "test@example.com", Password: "pass"},
+		},
+		// AuthKeyはSAMユーザーとルートアカウントより優先する
+		{
+			name: "auth key over password",
+			env: map[string]string{
+				"SORACOM_AUTH_KEY_ID": "keyId-1", "SORACOM_AUTH_KEY": "secret-1",
+				"SORACOM_OPERATOR_ID": "OP1", "SORACOM_USERNAME": "user",
+				"SORACOM_EMAIL": "test@example.com", "SORACOM_PASSWORD": "pass"},
+			want: &soracomCredential{AuthKeyId: "keyId-1", AuthKey: "secret-1"},
+		},
+		{
+			name: "sam user over root account",
+			env: map[string]string{
+				"SORACOM_OPERATOR_ID": "OP1", "SORACOM_USERNAME": "user",
+				"SORACOM_EMAIL": "test@example.com", "SORACOM_PASSWORD": "pass"},
+			want: &soracomCredential{OperatorId: "OP1", UserName: "user", Password: "pass"},
+		},
+		// 揃っていない組み合わせは使用しない
+		{name: "auth key without secret", env: map[string]string{"SORACOM_AUTH_KEY_ID": "keyId-1"}},
+		{name: "email without password", env: map[string]string{"SORACOM_EMAIL": "test@example.com"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, key := range credentialEnvKeys {
+				t.Setenv(key, test.env[key])
+			}
+			got := credentialFromEnv()
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("credential = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// プロファイルを指定した場合は環境変数より優先し、プロファイルに認証情報が無ければエラーにする
+func TestGetCredentialPrecedence(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile string
+		want    *soracomCredential
+		wantErr bool
+	}{
+		{name: "env", want: &soracomCredential{AuthKeyId: "keyId-env", AuthKey: "secret-env"}},
+		{
+			name:    "profile auth key",
+			profile: `{"authKeyId": "keyId-profile", "authKey": "secret-profile", "email": "test@example.com", "password": "pass"}`,
+			want:    &soracomCredential{AuthKeyId: "keyId-profile", AuthKey: "secret-profile"},
+		},
+		{
+			name:    "profile sam user",
+			profile: `{"operatorId": "OP1", "username": "user", "password": "pass"}`,
+			want:    &soracomCredential{OperatorId: "OP1", UserName: "user", Password: "pass"},
+		},
+		{
+			name:    "profile root account",
+			profile: `{"email": "test@example.com", "password": "pass"}`,
+			want:    &soracomCredential{Email: "test@example.com", Password: "pass"},
+		},
+		{name: "profile without credential", profile: `{"coverageType": "jp"}`, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, key := range credentialEnvKeys {
+				t.Setenv(key, "")
+			}
+			t.Setenv("SORACOM_AUTH_KEY_ID", "keyId-env")
+			t.Setenv("SORACOM_AUTH_KEY", "secret-env")
+			var profile *soracomProfile
+			if test.profile != "" {
+				writeTestProfile(t, "test", test.profile)
+				var err error
+				profile, err = loadSoracomProfile("test")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := getCredential(profile, "")
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("credential = %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("credential = %+v, want %+v", got, test.want)
+			}
+			identity, email := credentialIdentity(profile)
+			if identity != test.want.identity() || email != "" {
+				t.Fatalf("identity = %q, %q, want %q", identity, email, test.want.identity())
+			}
+		})
+	}
+}
+
+func TestCredentialIdentity(t *testing.T) {
+	tests := []struct {
+		credential soracomCredential
+		want       string
+	}{
+		{credential: soracomCredential{AuthKeyId: "keyId-1", AuthKey: "secret-1"}, want: "authKeyId:keyId-1"},
+		{credential: soracomCredential{OperatorId: "OP1", UserName: "user", Password: "pass"}, want: "user:OP1/user"},
+		{credential: soracomCredential{Email: "test@example.com", Password: "pass"}, want: "email:test@example.com"},
+		{credential: soracomCredential{}, want: ""},
+	}
+	for _, test := range tests {
+		if got := test.credential.identity(); got != test.want {
+			t.Errorf("%+v: identity = %q, want %q", test.credential, got, test.want)
+		}
+	}
+}
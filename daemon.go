@@ -7,16 +7,22 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/1stship/inventoryd"
 )
 
-func runDaemonMode(endpoint string) error {
+// runDaemonMode はinventorydを起動する
+// deviceArgsは開始の要求で起動するdeviceモードに渡す引数
+func runDaemonMode(endpoint string, deviceArgs []string) error {
 	exe, err := os.Executable()
 	rootDir := filepath.Join(exe, "..")
 	config := &inventoryd.Config{
 		EndpointClientName: endpoint, RootPath: rootDir, ObserveInterval: 60, BootstrapServer: bootstrapServer}
-	createDefaultFiles(config)
+	err = createDefaultFiles(config, deviceArgs)
+	if err != nil {
+		return errors.New("fail to create resource files: " + err.Error())
+	}
 	handler := &inventoryd.HandlerFile{ResourceDirPath: filepath.Join(config.RootPath, resourcePath)}
 	bootstrap := new(inventoryd.Inventoryd)
 	err = bootstrap.Bootstrap(config, handler)
@@ -34,7 +40,9 @@ func runDaemonMode(endpoint string) error {
 	return nil
 }
 
-func createDefaultFiles(config *inventoryd.Config) error {
+// createDefaultFiles は定義ファイルとリソースファイルを作成する
+// 実行可能リソースのスクリプトは起動時の引数を反映するため毎回書き込む
+func createDefaultFiles(config *inventoryd.Config, deviceArgs []string) error {
 	modelsDirPath := filepath.Join(config.RootPath, modelsPath)
 	_, err := os.Stat(modelsDirPath)
 	if os.IsNotExist(err) {
@@ -75,31 +83,37 @@ func createDefaultFiles(config *inventoryd.Config) error {
 		if os.IsNotExist(err) {
 			os.Mkdir(objectDirPath, 0755)
 		}
-		for i := 0; i < 4; i++ {
+		// descriptionの分割数に合わせてインスタンスを用意する
+		// 既存のインスタンスは残し、不足しているインスタンスとリソースのみ作成する
+		// 以前のバージョンで作成したインスタンスの少ないリソースファイルは起動時にここで拡張する
+		// 拡張するまでの間、デバイス側は作成済みのインスタンスのみを使用する
+		for i := 0; i < signalingInstanceCount; i++ {
 			instanceID := (uint16)(i)
 			instanceDirPath := filepath.Join(objectDirPath, strconv.Itoa((int)(instanceID)))
 			_, err := os.Stat(instanceDirPath)
-			if !os.IsNotExist(err) {
-				continue
+			if os.IsNotExist(err) {
+				os.Mkdir(instanceDirPath, 0755)
 			}
-			os.Mkdir(instanceDirPath, 0755)
 			for _, resourceDefinition := range objectDefinition.Resources {
 				resourceFilePath := filepath.Join(instanceDirPath, strconv.Itoa((int)(resourceDefinition.ID)))
-				_, err := os.Stat(resourceFilePath)
-				if !os.IsNotExist(err) {
-					continue
-				}
-				exe, err := os.Executable()
+				exe, _ := os.Executable()
 				if resourceDefinition.Excutable {
 					var script string
 					if resourceDefinition.ID == 4 {
-						script = fmt.Sprintf("#/bin/bash\n%s --mode execute", exe)
+						script = fmt.Sprintf("#/bin/bash\n%s --mode execute%s", exe, shellQuoteArgs(deviceArgs))
 					} else if resourceDefinition.ID == 6 {
-						script = fmt.Sprintf("#/bin/bash\npkill -f -x \"%s --mode device\"", exe)
+						script = fmt.Sprintf("#/bin/bash\npkill -f \"^%s --mode device( |$)\"", exe)
 					} else {
 						script = fmt.Sprintf("#/bin/bash\necho \"execute %s script\"", resourceDefinition.Name)
 					}
-					ioutil.WriteFile(resourceFilePath, []byte(script), 0755)
+					// スクリプトはdaemonモードと同じユーザーで実行するため所有者のみに許可し、既存のファイルも同じパーミッションにする
+					// TURNサーバーの認証情報はdeviceModeArgsで引数に含めないようにしている
+					ioutil.WriteFile(resourceFilePath, []byte(script), 0700)
+					os.Chmod(resourceFilePath, 0700)
+					continue
+				}
+				_, err := os.Stat(resourceFilePath)
+				if !os.IsNotExist(err) {
 					continue
 				}
 				switch resourceDefinition.Type {
@@ -119,3 +133,12 @@ func createDefaultFiles(config *inventoryd.Config) error {
 	}
 	return nil
 }
+
+// shellQuoteArgs は引数をシェルのスクリプトに埋め込めるように単一引用符で囲み、先頭に空白を付けて連結する
+func shellQuoteArgs(args []string) string {
+	quoted := ""
+	for _, arg := range args {
+		quoted += " '" + strings.Replace(arg, "'", "'\\''", -1) + "'"
+	}
+	return quoted
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -12,54 +11,205 @@ import (
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/kr/pty"
 	"github.com/pion/webrtc"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
+// loginShellCommand はデバイスで起動するログインシェル
+var loginShellCommand = []string{"/bin/bash", "-l"}
+
+// deviceShell はクライアントから指定されたコマンドのプロセス
+// コマンドの指定が無い場合はPTY上でログインシェルを起動する
 type deviceShell struct {
+	mu    sync.Mutex
+	cmd   *exec.Cmd
 	ptmx  *os.File
+	stdin io.WriteCloser
 	state *terminal.State
+	size  *pty.Winsize
+}
+
+// resize は端末サイズを変更する
+// シェルの起動前に受信した場合は起動時に適用する
+func (s *deviceShell) resize(size *pty.Winsize) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.size = size
+	if s.ptmx != nil {
+		pty.Setsize(s.ptmx, size)
+	}
 }
 
-func runDeviceMode(rootDir string) error {
-	err := clearWebrtcResources(rootDir)
+func (s *deviceShell) start(cmd *exec.Cmd) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cmd != nil {
+		return errors.New("command is already started")
+	}
+	s.cmd = cmd
+	var err error
+	if s.size != nil {
+		s.ptmx, err = pty.StartWithSize(cmd, s.size)
+	} else {
+		s.ptmx, err = pty.Start(cmd)
+	}
 	if err != nil {
 		return err
 	}
-	peerConnection, err := createPeerConnection()
+	s.stdin = s.ptmx
+	return nil
+}
+
+// startCommand はPTYを使わずにコマンドを起動し、標準出力と標準エラー出力を別々に書き込む
+func (s *deviceShell) startCommand(cmd *exec.Cmd, stdout, stderr io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cmd != nil {
+		return errors.New("command is already started")
+	}
+	s.cmd = cmd
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		return err
 	}
-	openCh := make(chan bool)
-	errCh := make(chan bool)
-	err = setupDeviceDataChannel(peerConnection, openCh, errCh)
+	err = cmd.Start()
 	if err != nil {
 		return err
 	}
-	err = createOffer(peerConnection, rootDir)
+	s.stdin = stdin
+	return nil
+}
+
+// copyInput はクライアントから受信した入力をプロセスの標準入力に書き込む
+// 起動前に受信した入力はstreamのキューで待たせ、起動後に呼ぶ
+// 入力の終端を受信した場合は標準入力を閉じる
+func (s *deviceShell) copyInput(stream *bridgeStream) {
+	err := stream.copyTo(s.stdin)
+	if err == nil {
+		s.closeStdin()
+	}
+}
+
+// wait はシェルの終了を待ち、終了コードを返す
+// シグナルで終了した場合は128+シグナル番号を返す
+func (s *deviceShell) wait() int {
+	err := s.cmd.Wait()
+	if err == nil {
+		return 0
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 1
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return exitErr.ExitCode()
+	}
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+// closeStdin はプロセスの標準入力を閉じる
+// PTYの場合は閉じると端末ごと終了してしまうため、EOF(Ctrl-D)を書き込む
+func (s *deviceShell) closeStdin() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ptmx != nil {
+		s.ptmx.Write([]byte{4})
+	} else if s.stdin != nil {
+		s.stdin.Close()
+	}
+}
+
+// signal はシェルのプロセスにシグナルを送る
+func (s *deviceShell) signal(signal syscall.Signal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cmd != nil && s.cmd.Process != nil {
+		s.cmd.Process.Signal(signal)
+	}
+}
+
+func runDeviceMode(rootDir string, config *sessionConfig) error {
+	store := &fileResourceStore{objectDirPath: filepath.Join(rootDir, resourcePath, "9")}
+	// リクエストIDを読み出せない場合はクライアントに通知できない
+	sig := newInventorySignaler(store)
+	err := sig.acceptRequest()
+	if err != nil {
+		return err
+	}
+	// 候補の書き込みに使用するインスタンスまで作成されていなければ、daemonモードの再起動で作成する必要がある
+	if signalingInstanceCountOf(store) <= deviceCandidateFirstInstanceID {
+		err = errors.New("signaling resources are not created: restart daemon mode")
+		sig.publishFailure(err.Error())
+		return err
+	}
+	// 別のセッションが接続中の場合はそのセッションのリソースを消さずにbusyを通知する
+	lock, err := acquireDeviceLock(rootDir)
 	if err != nil {
+		if _, ok := err.(*deviceBusyError); ok {
+			sig.publishBusy()
+		} else {
+			sig.publishFailure(err.Error())
+		}
 		return err
 	}
-	err = waitRecvAnswer(rootDir)
+	defer lock.release()
+	err = clearWebrtcResources(store, signalingInstanceCountOf(store))
 	if err != nil {
+		sig.publishFailure(err.Error())
 		return err
 	}
-	err = recvAnswer(peerConnection, rootDir)
+	err = runDeviceSession(sig, config)
 	if err != nil {
+		sig.publishFailure(err.Error())
 		return err
 	}
+	return sig.publishStatus(signalingStatusIdle)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
-	select {
-	case <-ctx.Done():
-		return errors.New("timeout wait open webRTC data channel")
-	case <-openCh:
+func runDeviceSession(sig signaler, config *sessionConfig) error {
+	peerConnection, err := createPeerConnection(config.ice)
+	if err != nil {
+		return err
 	}
+	openCh := make(chan bool)
+	done := newSessionDone()
+	err = setupDeviceDataChannel(peerConnection, openCh, done)
+	if err != nil {
+		return err
+	}
+	trickle := newTrickleICE(peerConnection, sig, done.finish)
+	trickleCtx, cancelTrickle := context.WithTimeout(context.Background(), config.signalingTimeout)
+	defer cancelTrickle()
+	err = createOffer(peerConnection, sig)
+	if err != nil {
+		return err
+	}
+	trickle.startPublishing(trickleCtx)
+	answerCtx, cancelAnswer := context.WithTimeout(context.Background(), config.signalingTimeout)
+	defer cancelAnswer()
+	err = recvAnswer(answerCtx, peerConnection, sig)
+	if err != nil {
+		return err
+	}
+	trickle.startReceiving(trickleCtx, peerConnection)
+
+	err = waitDataChannelOpen(openCh, done, config.signalingTimeout)
+	if err != nil {
+		return err
+	}
+	sig.publishStatus(signalingStatusConnected)
 
 	trapSignals := []os.Signal{
 		syscall.SIGINT,
@@ -70,20 +220,71 @@ func runDeviceMode(rootDir string) error {
 	select {
 	case <-sigCh:
 		return nil
-	case <-errCh:
+	case <-done.done():
 		return nil
 	}
 }
 
-func clearWebrtcResources(rootDir string) error {
-	resources := [][4]string{
-		{"9", "0", "0", ""}, {"9", "1", "0", ""}, {"9", "2", "0", ""}, {"9", "3", "0", ""},
-		{"9", "0", "3", ""}, {"9", "1", "3", ""}, {"9", "2", "3", ""}, {"9", "3", "3", ""},
-		{"9", "0", "7", "0"},
-		{"9", "0", "14", ""}}
+// deviceBusyError は別のセッションのデバイスモードのプロセスが動作中であることを表す
+type deviceBusyError struct{}
+
+func (e *deviceBusyError) Error() string {
+	return "another session is in progress"
+}
+
+// deviceLock はデバイスモードのプロセスが同時に複数動作しないようにするためのロックファイル
+// flockによるロックはプロセスの終了時にカーネルが解放するため、異常終了や再起動の後に残ったファイルで接続できなくなることはない
+type deviceLock struct {
+	file *os.File
+}
+
+func acquireDeviceLock(rootDir string) (*deviceLock, error) {
+	file, err := os.OpenFile(filepath.Join(rootDir, "device.pid"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.New("fail to open device lock")
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, &deviceBusyError{}
+		}
+		return nil, errors.New("fail to acquire device lock")
+	}
+	// ロックしているプロセスを確認できるようにPIDを書き込む
+	file.Truncate(0)
+	fmt.Fprintf(file, "%d", os.Getpid())
+	return &deviceLock{file: file}, nil
+}
+
+// release はロックを解放する
+// ファイルを削除すると別のプロセスが削除前のファイルをロックしたまま新しいファイルをロックできてしまうため、ファイルは残す
+func (l *deviceLock) release() {
+	l.file.Close()
+}
+
+// resourceValue はリソースに書き込む値
+type resourceValue struct {
+	instanceID int
+	resourceID int
+	value      string
+}
+
+// clearWebrtcResources はinstanceCount個のインスタンスのシグナリング用のリソースを消去する
+func clearWebrtcResources(store resourceStore, instanceCount int) error {
+	resources := []resourceValue{
+		{0, statusResourceID, strconv.Itoa(signalingStatusIdle)},
+		{0, notifyResourceID, ""},
+		{reasonInstanceID, reasonResourceID, ""}}
+	for i := 0; i < instanceCount; i++ {
+		resources = append(resources,
+			resourceValue{i, offerResourceID, ""},
+			resourceValue{i, answerResourceID, ""},
+			resourceValue{i, deviceCandidateResourceID, ""},
+			resourceValue{i, clientCandidateResourceID, ""})
+	}
 	for _, resource := range resources {
-		fileForClear := filepath.Join(rootDir, resourcePath, resource[0], resource[1], resource[2])
-		err := ioutil.WriteFile(fileForClear, []byte(resource[3]), 0644)
+		err := store.writeResource(resource.instanceID, resource.resourceID, resource.value)
 		if err != nil {
 			return errors.New("fail to clear resource")
 		}
@@ -91,165 +292,291 @@ func clearWebrtcResources(rootDir string) error {
 	return nil
 }
 
-func setupDeviceDataChannel(peerConnection *webrtc.PeerConnection, openCh, errCh chan bool) error {
-	dataChannel, err := peerConnection.CreateDataChannel("data", nil)
+func setupDeviceDataChannel(peerConnection *webrtc.PeerConnection, openCh chan bool, done *sessionDone) error {
+	dataChannel, err := peerConnection.CreateDataChannel(dataChannelLabel, nil)
 	if err != nil {
 		return errors.New("fail to create data channel")
 	}
+	stderrChannel, err := peerConnection.CreateDataChannel(stderrChannelLabel, nil)
+	if err != nil {
+		return errors.New("fail to create stderr channel")
+	}
+	controlDataChannel, err := peerConnection.CreateDataChannel(controlChannelLabel, nil)
+	if err != nil {
+		return errors.New("fail to create control channel")
+	}
 	shell := &deviceShell{}
-	keepAliveCh := make(chan bool)
-	finishCh := make(chan bool)
+	control := newControlChannel(controlDataChannel)
+	// 入出力はOnMessageで書き込みを待たないようにキューを介し、相手の書き込みに合わせて送信する
+	dataStream := newBridgeStream(dataChannel)
+	stderrStream := newBridgeStream(stderrChannel)
+	peerConnection.OnDataChannel(func(dataChannel *webrtc.DataChannel) {
+		if acceptTransferChannel(dataChannel) || acceptSFTPChannel(dataChannel) {
+			return
+		}
+		acceptForwardChannel(dataChannel)
+	})
+	dataOpenCh := make(chan struct{})
+	stderrOpenCh := make(chan struct{})
 
-	dataChannel.OnOpen(func() {
-		openCh <- true
-		cmd := exec.Command("/bin/bash", "-l")
-		shell.ptmx, _ = pty.Start(cmd)
-		shell.state, _ = terminal.MakeRaw(int(os.Stdin.Fd()))
+	controlDataChannel.OnOpen(func() {
+		control.sendHello()
+		control.startKeepAlive(done.finish)
+	})
+
+	controlDataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		message, err := control.receive(msg)
 		if err != nil {
-			panic(err)
+			control.sendError(err.Error())
+			return
 		}
-		defer func() { _ = terminal.Restore(int(os.Stdin.Fd()), shell.state) }()
-		go func() {
-			io.Copy(shell.ptmx, os.Stdin)
-		}()
-
-		go func() {
-			t := time.NewTicker(5 * time.Second)
-			defer t.Stop()
-			for {
-				select {
-				case <-finishCh:
-					return
-				case <-t.C:
-					dataChannel.SendText("Keep Alive")
-				}
+		switch message.Type {
+		case controlTypeHello:
+			err = control.checkHello(message)
+			if err != nil {
+				done.finish()
 			}
-		}()
-
-		go func() {
-			for {
-				ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-				defer cancel()
-				select {
-				case <-ctx.Done():
-					finishCh <- true
-					errCh <- true
-					return
-				case <-keepAliveCh:
+		case controlTypeExec:
+			go func() {
+				<-dataOpenCh
+				<-stderrOpenCh
+				if len(message.Command) == 0 {
+					runDeviceShell(shell, dataStream, stderrStream, control, done)
+				} else {
+					runDeviceCommand(shell, message.Command, dataStream, stderrStream, control, done)
 				}
-			}
-		}()
-
-		buf := make([]byte, 4096)
-		for {
-			readLen, err := shell.ptmx.Read(buf)
+			}()
+		case controlTypeListen:
+			err = startRemoteForward(peerConnection, message.Address)
 			if err != nil {
-				if err == io.EOF {
-					continue
-				}
-				dataChannel.SendText("terminate")
-
-				// terminateが届くまでの間にプロセスが終了しないように一定時間待つ
-				time.Sleep(5 * time.Second)
-				return
-			} else {
-				err = dataChannel.Send(buf[:readLen])
-				if err != nil {
-					fmt.Fprintln(os.Stderr, err)
-					return
-				}
+				control.send(&controlMessage{Type: controlTypeListenError, Address: message.Address, Message: err.Error()})
+			}
+		case controlTypeResize:
+			shell.resize(&pty.Winsize{Cols: message.Cols, Rows: message.Rows})
+		case controlTypeSignal:
+			signal, ok := signalNames[message.Signal]
+			if ok {
+				shell.signal(signal)
 			}
+		case controlTypeExit:
+			// クライアント側からの終了の通知
+			done.finish()
+		case controlTypeError:
+			fmt.Fprintln(os.Stderr, message.Message)
+			done.finish()
 		}
 	})
 
+	dataChannel.OnOpen(func() {
+		openCh <- true
+		close(dataOpenCh)
+	})
+
+	stderrChannel.OnOpen(func() {
+		close(stderrOpenCh)
+	})
+
 	dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
-		if msg.IsString {
-			keepAliveCh <- true
-		} else if shell.ptmx != nil {
-			shell.ptmx.Write(msg.Data)
+		_, err := dataStream.receive(msg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			done.finish()
 		}
 	})
+	dataChannel.OnClose(dataStream.close)
+	stderrChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		stderrStream.receive(msg)
+	})
+	stderrChannel.OnClose(stderrStream.close)
 	return nil
 }
 
-func createOffer(peerConnection *webrtc.PeerConnection, rootDir string) error {
-	offer, err := peerConnection.CreateOffer(nil)
+// deviceHomeDir はシェルやSFTPサーバーを開始するディレクトリを返す
+// sshと同様にホームディレクトリから開始し、取得できない場合はデバイスモードのプロセスの作業ディレクトリとする
+func deviceHomeDir() string {
+	home, err := os.UserHomeDir()
 	if err != nil {
-		return errors.New("fail to create offer")
+		return ""
 	}
-	err = peerConnection.SetLocalDescription(offer)
-	if err != nil {
-		return errors.New("fail to set device local description")
-	}
-	offerDescriptionBytes, err := json.Marshal(offer)
+	return home
+}
+
+// deviceCommand はホームディレクトリを作業ディレクトリとしてcommandを実行するexec.Cmdを返す
+// デバイスモードのプロセス自体の作業ディレクトリは変更しない
+func deviceCommand(command []string) *exec.Cmd {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Dir = deviceHomeDir()
+	return cmd
+}
+
+// runDeviceShell はPTY上でログインシェルを起動し、端末の出力をデータチャネルに送信する
+func runDeviceShell(shell *deviceShell, dataStream, stderrStream *bridgeStream, control *controlChannel, done *sessionDone) {
+	cmd := deviceCommand(loginShellCommand)
+	err := shell.start(cmd)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "fail to serialize offer")
-		os.Exit(1)
+		fmt.Fprintf(dataStream, "fail to start shell: %s\r\n", err)
+		sendExit(control, done, startFailureExitCode(err), dataStream.dataChannel, stderrStream.dataChannel)
+		return
 	}
-	// offerを対応するリソースに保存
-	for i := 0; i < 4; i++ {
-		offerFile := filepath.Join(rootDir, resourcePath, "9", strconv.Itoa(i), "0")
-		if len(offerDescriptionBytes) < (i+1)*800 {
-			ioutil.WriteFile(offerFile, offerDescriptionBytes[(i*800):], 0644)
-			break
+	go shell.copyInput(dataStream)
+	shell.state, _ = terminal.MakeRaw(int(os.Stdin.Fd()))
+	defer func() { _ = terminal.Restore(int(os.Stdin.Fd()), shell.state) }()
+	go func() {
+		io.Copy(shell.ptmx, os.Stdin)
+	}()
+
+	buf := make([]byte, 4096)
+	for {
+		readLen, err := shell.ptmx.Read(buf)
+		if err != nil {
+			if err == io.EOF {
+				continue
+			}
+			sendExit(control, done, shell.wait(), dataStream.dataChannel, stderrStream.dataChannel)
+			return
 		} else {
-			ioutil.WriteFile(offerFile, offerDescriptionBytes[(i*800):((i+1)*800)], 0644)
+			_, err = dataStream.Write(buf[:readLen])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return
+			}
 		}
 	}
-	err = updateStatus("1", rootDir)
+}
+
+// runDeviceCommand はPTYを使わずにコマンドを実行し、標準出力と標準エラー出力を別々のデータチャネルに送信する
+func runDeviceCommand(shell *deviceShell, command []string, dataStream, stderrStream *bridgeStream, control *controlChannel, done *sessionDone) {
+	cmd := deviceCommand(command)
+	err := shell.startCommand(cmd, dataStream, stderrStream)
 	if err != nil {
-		return err
+		fmt.Fprintf(stderrStream, "fail to start command: %s: %s\n", command[0], err)
+		sendExit(control, done, startFailureExitCode(err), dataStream.dataChannel, stderrStream.dataChannel)
+		return
 	}
-	return nil
+	go shell.copyInput(dataStream)
+	sendExit(control, done, shell.wait(), dataStream.dataChannel, stderrStream.dataChannel)
 }
 
-func waitRecvAnswer(rootDir string) error {
-	notifyFile := filepath.Join(rootDir, resourcePath, "9", "0", "14")
-	for i := 0; i < 120; i++ {
-		time.Sleep(1 * time.Second)
-		notify, err := ioutil.ReadFile(notifyFile)
-		if err != nil {
-			continue
-		}
-		if string(notify) == "done" {
-			return nil
-		}
+// startFailureExitCode はシェルと同様に、起動できなかった理由に応じた終了コードを返す
+// コマンドが見つからない場合は127、実行権限が無い場合は126、それ以外(PTYの作成の失敗など)は1とする
+func startFailureExitCode(err error) int {
+	switch {
+	case errors.Is(err, exec.ErrNotFound) || os.IsNotExist(err):
+		return 127
+	case os.IsPermission(err):
+		return 126
 	}
-	return errors.New("timeout to recv answer")
+	return 1
 }
 
-func recvAnswer(peerConnection *webrtc.PeerConnection, rootDir string) error {
-	// 対応するリソースからAnswerを読み出し
-	answerDescriptionBytes := []byte{}
-	for i := 0; i < 4; i++ {
-		answerFile := filepath.Join(rootDir, resourcePath, "9", strconv.Itoa(i), "3")
-		description, err := ioutil.ReadFile(answerFile)
-		if err != nil {
-			return errors.New("fail to read answer")
-		}
-		answerDescriptionBytes = append(answerDescriptionBytes, description...)
-		if len(description) < 800 {
-			break
+// sendExit は出力のデータチャネルを閉じてから終了コードを通知し、セッションを終了する
+// クライアント側は出力のデータチャネルが閉じるまで待ってから終了するため、exitより前の出力は取りこぼさない
+func sendExit(control *controlChannel, done *sessionDone, exitCode int, dataChannels ...*webrtc.DataChannel) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, dataChannel := range dataChannels {
+		for dataChannel.BufferedAmount() > 0 && ctx.Err() == nil {
+			time.Sleep(10 * time.Millisecond)
 		}
+		dataChannel.Close()
 	}
-	var answer webrtc.SessionDescription
-	err := json.Unmarshal(answerDescriptionBytes, &answer)
+	control.send(&controlMessage{Type: controlTypeExit, ExitCode: exitCode})
+
+	// exitが届くまでの間にプロセスが終了しないように一定時間待つ
+	time.Sleep(5 * time.Second)
+	control.close()
+	done.finish()
+}
+
+func createOffer(peerConnection *webrtc.PeerConnection, sig signaler) error {
+	offer, err := peerConnection.CreateOffer(nil)
 	if err != nil {
-		return errors.New("fail to parse answer")
+		return errors.New("fail to create offer")
+	}
+	err = peerConnection.SetLocalDescription(offer)
+	if err != nil {
+		return errors.New("fail to set device local description")
+	}
+	return sig.publishOffer(offer)
+}
+
+func recvAnswer(ctx context.Context, peerConnection *webrtc.PeerConnection, sig signaler) error {
+	answer, err := sig.awaitAnswer(ctx)
+	if err != nil {
+		return err
 	}
 	err = peerConnection.SetRemoteDescription(answer)
 	if err != nil {
 		return errors.New("fail to set device remote description")
 	}
-	updateStatus("2", rootDir)
-	return nil
+	return sig.publishStatus(signalingStatusAnswered)
+}
+
+// fileResourceStore はinventorydが参照するローカルのリソースファイルを読み書きする
+type fileResourceStore struct {
+	objectDirPath string
+}
+
+func (s *fileResourceStore) resourceFilePath(instanceID, resourceID int) string {
+	return filepath.Join(s.objectDirPath, strconv.Itoa(instanceID), strconv.Itoa(resourceID))
 }
 
-func updateStatus(status, rootDir string) error {
-	statusFile := filepath.Join(rootDir, resourcePath, "9", "0", "7")
-	err := ioutil.WriteFile(statusFile, []byte(status), 0644)
+func (s *fileResourceStore) readResource(instanceID, resourceID int) (string, error) {
+	value, err := ioutil.ReadFile(s.resourceFilePath(instanceID, resourceID))
 	if err != nil {
-		return errors.New("fail to update status")
+		return "", err
 	}
-	return nil
+	return string(value), nil
+}
+
+// instanceCount はインスタンス0から連続して作成済みのインスタンス数を返す
+func (s *fileResourceStore) instanceCount() int {
+	count := 0
+	for {
+		_, err := os.Stat(filepath.Join(s.objectDirPath, strconv.Itoa(count)))
+		if err != nil {
+			return count
+		}
+		count++
+	}
+}
+
+func (s *fileResourceStore) writeResource(instanceID, resourceID int, value string) error {
+	return ioutil.WriteFile(s.resourceFilePath(instanceID, resourceID), []byte(value), 0644)
+}
+
+// watchResource はリソースファイルのあるディレクトリを監視し、リソースファイルの変更を通知する
+// inventorydはファイルを置き換えて書き込むことがあるため、ファイルではなくディレクトリを監視する
+func (s *fileResourceStore) watchResource(instanceID, resourceID int) (<-chan struct{}, func(), error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, nil, err
+	}
+	resourceFilePath := s.resourceFilePath(instanceID, resourceID)
+	err = watcher.Add(filepath.Dir(resourceFilePath))
+	if err != nil {
+		watcher.Close()
+		return nil, nil, err
+	}
+	changed := make(chan struct{}, 1)
+	go func() {
+		for event := range watcher.Events {
+			if filepath.Clean(event.Name) != resourceFilePath {
+				continue
+			}
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	go func() {
+		for range watcher.Errors {
+		}
+	}()
+	return changed, func() { watcher.Close() }, nil
+}
+
+func (s *fileResourceStore) executeResource(instanceID, resourceID int) error {
+	return errors.New("execute is not supported on device")
 }
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kr/pty"
+	"github.com/pion/webrtc"
+)
+
+// newTestFileResourceStore はinstanceCount個のインスタンスのディレクトリを持つfileResourceStoreを作成する
+func newTestFileResourceStore(t *testing.T, instanceCount int) *fileResourceStore {
+	objectDirPath := t.TempDir()
+	for i := 0; i < instanceCount; i++ {
+		err := os.Mkdir(filepath.Join(objectDirPath, strconv.Itoa(i)), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &fileResourceStore{objectDirPath: objectDirPath}
+}
+
+func TestFileResourceStoreInstanceCount(t *testing.T) {
+	for _, instanceCount := range []int{0, 4, signalingInstanceCount, signalingInstanceCount + 2} {
+		store := newTestFileResourceStore(t, instanceCount)
+		if got := store.instanceCount(); got != instanceCount {
+			t.Errorf("instanceCount = %d, want %d", got, instanceCount)
+		}
+		want := instanceCount
+		if want > signalingInstanceCount {
+			want = signalingInstanceCount
+		}
+		if got := signalingInstanceCountOf(store); got != want {
+			t.Errorf("signalingInstanceCountOf = %d, want %d", got, want)
+		}
+	}
+}
+
+// 以前のバージョンで作成したインスタンスの少ないリソースファイルでも、作成済みの範囲で動作すること
+func TestSignalingWithFewInstances(t *testing.T) {
+	store := newTestFileResourceStore(t, 4)
+	err := clearWebrtcResources(store, signalingInstanceCountOf(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(filepath.Join(store.objectDirPath, "4"))
+	if !os.IsNotExist(err) {
+		t.Fatal("clearWebrtcResources must not create instances")
+	}
+
+	device := newInventorySignaler(store)
+	err = device.publishOffer(testOffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, _, err := device.readDescription(offerResourceID)
+	if err != nil || offer != testOffer {
+		t.Fatalf("offer = %+v, %v", offer, err)
+	}
+	// 4インスタンスに収まらないdescriptionはエラーになる
+	large := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: strings.Repeat("a=x-"+strings.Repeat("0123456789", 10)+"\r\n", 200)}
+	device.encoding = descriptionEncodingJSON
+	err = device.writeDescription(offerResourceID, large)
+	if err == nil {
+		t.Fatal("want error for description exceeding created instances")
+	}
+}
+
+func TestStartFailureExitCode(t *testing.T) {
+	dir := t.TempDir()
+	notExecutable := filepath.Join(dir, "not-executable")
+	err := ioutil.WriteFile(notExecutable, []byte("#!/bin/sh\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		command string
+		want    int
+	}{
+		{command: "inventory-terminal-no-such-command", want: 127},
+		{command: filepath.Join(dir, "no-such-command"), want: 127},
+		{command: notExecutable, want: 126},
+	}
+	for _, test := range tests {
+		err := exec.Command(test.command).Start()
+		if err == nil {
+			t.Fatalf("%s: want start error", test.command)
+		}
+		if got := startFailureExitCode(err); got != test.want {
+			t.Errorf("%s: exit code = %d, want %d (%v)", test.command, got, test.want, err)
+		}
+	}
+	if got := startFailureExitCode(errors.New("fail to open pty")); got != 1 {
+		t.Errorf("exit code = %d, want 1", got)
+	}
+}
+
+// 別のプロセスが保持しているロックはbusyとし、以前のプロセスが残したPIDファイルでは接続を拒否しない
+func TestAcquireDeviceLock(t *testing.T) {
+	dir := t.TempDir()
+	// 再起動前のプロセスのPIDが残っている場合
+	err := ioutil.WriteFile(filepath.Join(dir, "device.pid"), []byte(strconv.Itoa(os.Getpid())), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock, err := acquireDeviceLock(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flockはファイルを開くごとのロックのため、同じプロセスでも2つ目は取得できない
+	_, err = acquireDeviceLock(dir)
+	if _, ok := err.(*deviceBusyError); !ok {
+		t.Fatalf("err = %v, want deviceBusyError", err)
+	}
+	lock.release()
+	lock, err = acquireDeviceLock(dir)
+	if err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+	lock.release()
+}
+
+// リソースファイルへの書き込みを監視で通知する
+func TestFileResourceStoreWatchResource(t *testing.T) {
+	store := newTestFileResourceStore(t, 1)
+	changed, stop, err := store.watchResource(0, statusResourceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	// 別のリソースへの書き込みは通知しない
+	err = store.writeResource(0, notifyResourceID, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+		t.Fatal("notified for another resource")
+	case <-time.After(100 * time.Millisecond):
+	}
+	err = store.writeResource(0, statusResourceID, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("not notified for the resource")
+	}
+}
+
+// 監視できる場合はポーリングを待たずに書き込みで戻る
+func TestWaitResourceWatch(t *testing.T) {
+	store := newTestFileResourceStore(t, 1)
+	sig := newInventorySignaler(store)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		store.writeResource(0, statusResourceID, "1")
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	value, err := sig.waitResource(ctx, 0, statusResourceID, func(value string) bool { return value == "1" })
+	if err != nil || value != "1" {
+		t.Fatalf("value = %q, %v, want 1", value, err)
+	}
+	if elapsed := time.Since(start); elapsed >= pollInitialInterval {
+		t.Fatalf("returned after %v, want before the first poll (%v)", elapsed, pollInitialInterval)
+	}
+}
+
+// シグナルで終了した場合は128+シグナル番号を返す
+func TestDeviceShellWaitExitCode(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   int
+	}{
+		{name: "success", script: "exit 0", want: 0},
+		{name: "exit status", script: "exit 3", want: 3},
+		{name: "signal", script: "kill -TERM $$", want: 128 + 15},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shell := &deviceShell{}
+			err := shell.startCommand(exec.Command("sh", "-c", test.script), ioutil.Discard, ioutil.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exitCode := shell.wait(); exitCode != test.want {
+				t.Fatalf("exit code = %d, want %d", exitCode, test.want)
+			}
+		})
+	}
+}
+
+func assertPtySize(t *testing.T, ptmx *os.File, want *pty.Winsize) {
+	t.Helper()
+	got, err := pty.GetsizeFull(ptmx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Cols != want.Cols || got.Rows != want.Rows {
+		t.Fatalf("size = %dx%d, want %dx%d", got.Cols, got.Rows, want.Cols, want.Rows)
+	}
+}
+
+// 起動後に受信したサイズはPTYに適用する
+func TestDeviceShellResize(t *testing.T) {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		t.Skip("pty is not available: " + err.Error())
+	}
+	defer ptmx.Close()
+	defer tty.Close()
+	shell := &deviceShell{ptmx: ptmx}
+	sizes := []*pty.Winsize{{Cols: 80, Rows: 24}, {Cols: 120, Rows: 40}}
+	for _, size := range sizes {
+		shell.resize(size)
+		assertPtySize(t, ptmx, size)
+	}
+}
+
+// 起動前に受信したサイズは起動時に適用する
+func TestDeviceShellResizeBeforeStart(t *testing.T) {
+	shell := &deviceShell{}
+	size := &pty.Winsize{Cols: 100, Rows: 30}
+	shell.resize(size)
+	err := shell.start(exec.Command("sh", "-c", "read line"))
+	if err != nil {
+		t.Skip("pty is not available: " + err.Error())
+	}
+	defer func() {
+		shell.signal(syscall.SIGKILL)
+		shell.wait()
+		shell.ptmx.Close()
+	}()
+	assertPtySize(t, shell.ptmx, size)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+func runListMode(client *soracomClient, format string) error {
+	err := loginSoracom(client)
+	if err != nil {
+		return err
+	}
+	devices, err := client.listDevices()
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "json":
+		out := json.NewEncoder(os.Stdout)
+		out.SetIndent("", "  ")
+		return out.Encode(devices)
+	case "table":
+		printDevices(os.Stdout, devices)
+		return nil
+	}
+	return errors.New("invalid format (table/json)")
+}
+
+// printDevices はデバイスの一覧を表形式でoutに出力する
+func printDevices(out io.Writer, devices []inventoryDevice) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NO\tDEVICE ID\tENDPOINT\tONLINE\tTAGS")
+	for i, device := range devices {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%t\t%s\n", i+1, device.DeviceId, device.Endpoint, device.Online, formatTags(device.Tags))
+	}
+	w.Flush()
+}
+
+func formatTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+tags[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// deviceSelector は接続先デバイスの指定
+type deviceSelector struct {
+	endpoint string
+	deviceID string
+	tags     tagFlags
+}
+
+// tagFlags は--tag key=valueの複数指定を受け付ける
+type tagFlags map[string]string
+
+func (t tagFlags) String() string {
+	return formatTags(t)
+}
+
+func (t tagFlags) Set(value string) error {
+	pair := strings.SplitN(value, "=", 2)
+	if len(pair) != 2 || pair[0] == "" {
+		return errors.New("tag must be key=value")
+	}
+	t[pair[0]] = pair[1]
+	return nil
+}
+
+func (t tagFlags) match(device inventoryDevice) bool {
+	for key, value := range t {
+		tagValue, ok := device.Tags[key]
+		if !ok || tagValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+// selectDevice は指定に従ってデバイスを選択する
+// デバイスIDまたはタグを指定した場合は該当するデバイスが1台でなければエラーとする
+// それ以外でエンドポイント名が省略された場合や複数のデバイスが該当する場合は対話的に選択する
+func selectDevice(client *soracomClient, selector *deviceSelector) (*inventoryDevice, error) {
+	if selector.deviceID != "" {
+		device, err := client.getDevice(selector.deviceID)
+		if err != nil {
+			// 認証やネットワークのエラーはそのまま返す
+			if apiErr, ok := err.(*apiError); ok && apiErr.statusCode == http.StatusNotFound {
+				return nil, errors.New("device not found: " + selector.deviceID)
+			}
+			return nil, err
+		}
+		if !selector.matchEndpoint(*device) || !selector.tags.match(*device) {
+			return nil, errors.New("device does not match --endpoint or --tag: " + selector.deviceID)
+		}
+		return device, nil
+	}
+	devices, err := client.listDevices()
+	if err != nil {
+		return nil, err
+	}
+	candidates := []inventoryDevice{}
+	for _, device := range devices {
+		if selector.matchEndpoint(device) && selector.tags.match(device) {
+			candidates = append(candidates, device)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		if len(selector.tags) > 0 {
+			return nil, errors.New("no device matches --tag " + formatTags(selector.tags))
+		}
+		return nil, errors.New("device not found")
+	case 1:
+		return &candidates[0], nil
+	}
+	if len(selector.tags) > 0 {
+		deviceIDs := make([]string, 0, len(candidates))
+		for _, device := range candidates {
+			deviceIDs = append(deviceIDs, device.DeviceId)
+		}
+		return nil, fmt.Errorf("%d devices match --tag %s: %s", len(candidates), formatTags(selector.tags), strings.Join(deviceIDs, ", "))
+	}
+	return pickDevice(candidates)
+}
+
+func (s *deviceSelector) matchEndpoint(device inventoryDevice) bool {
+	return s.endpoint == "" || device.Endpoint == s.endpoint
+}
+
+// pickDevice は一覧から対話的にデバイスを選択する
+// 標準出力はリモートの出力に使用するため、一覧と入力の案内は標準エラー出力に表示する
+func pickDevice(devices []inventoryDevice) (*inventoryDevice, error) {
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, errors.New("multiple devices found, specify --endpoint")
+	}
+	fmt.Fprintln(os.Stderr, "")
+	printDevices(os.Stderr, devices)
+	for {
+		input := getInput(fmt.Sprintf("Select device (1-%d): ", len(devices)))
+		index, err := strconv.Atoi(input)
+		if err == nil && index >= 1 && index <= len(devices) {
+			return &devices[index-1], nil
+		}
+	}
+}
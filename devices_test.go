@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTagFlagsSet(t *testing.T) {
+	tests := []struct {
+		values  []string
+		want    tagFlags
+		wantErr bool
+	}{
+		{values: []string{"site=osaka"}, want: tagFlags{"site": "osaka"}},
+		{values: []string{"site=osaka", "role=gateway"}, want: tagFlags{"site": "osaka", "role": "gateway"}},
+		{values: []string{"site=osaka", "site=tokyo"}, want: tagFlags{"site": "tokyo"}},
+		{values: []string{"note=a=b"}, want: tagFlags{"note": "a=b"}},
+		{values: []string{"empty="}, want: tagFlags{"empty": ""}},
+		{values: []string{"site"}, wantErr: true},
+		{values: []string{"=osaka"}, wantErr: true},
+	}
+	for _, test := range tests {
+		tags := tagFlags{}
+		var err error
+		for _, value := range test.values {
+			err = tags.Set(value)
+			if err != nil {
+				break
+			}
+		}
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%v: want error", test.values)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.values, err)
+			continue
+		}
+		if !reflect.DeepEqual(tags, test.want) {
+			t.Errorf("%v: tags = %v, want %v", test.values, tags, test.want)
+		}
+	}
+}
+
+func TestTagFlagsMatch(t *testing.T) {
+	device := inventoryDevice{DeviceId: "d-1", Tags: map[string]string{"site": "osaka", "role": "gateway"}}
+	tests := []struct {
+		tags tagFlags
+		want bool
+	}{
+		{tags: tagFlags{}, want: true},
+		{tags: tagFlags{"site": "osaka"}, want: true},
+		{tags: tagFlags{"site": "osaka", "role": "gateway"}, want: true},
+		{tags: tagFlags{"site": "tokyo"}, want: false},
+		{tags: tagFlags{"site": "osaka", "role": "camera"}, want: false},
+		{tags: tagFlags{"owner": ""}, want: false},
+	}
+	for _, test := range tests {
+		if got := test.tags.match(device); got != test.want {
+			t.Errorf("%v: match = %t, want %t", test.tags, got, test.want)
+		}
+	}
+}
+
+func TestTagFlagsString(t *testing.T) {
+	tags := tagFlags{"site": "osaka", "role": "gateway"}
+	if got, want := tags.String(), "role=gateway,site=osaka"; got != want {
+		t.Errorf("String = %q, want %q", got, want)
+	}
+}
+
+// --device-idで指定したデバイスが存在しない場合のみdevice not foundとし、それ以外のエラーはそのまま返す
+func TestSelectDeviceByID(t *testing.T) {
+	_, httpServer, _ := newTestMockAPIServer(t)
+	tests := []struct {
+		name     string
+		deviceID string
+		token    *soracomToken
+		wantErr  string
+	}{
+		{name: "found", deviceID: mockDeviceID},
+		{name: "not found", deviceID: "d-unknown", wantErr: "device not found: d-unknown"},
+		{
+			name:     "invalid token",
+			deviceID: mockDeviceID,
+			token:    &soracomToken{ApiKey: mockApiKey, OperatorId: mockOperatorId, Token: "invalid"},
+			wantErr:  "fail to request API",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newTestSoracomClient(t, httpServer.URL)
+			if test.token != nil {
+				client.token = test.token
+			}
+			device, err := selectDevice(client, &deviceSelector{deviceID: test.deviceID})
+			if test.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.wantErr) {
+					t.Fatalf("err = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if device.DeviceId != mockDeviceID {
+				t.Fatalf("device = %+v, want %q", device, mockDeviceID)
+			}
+		})
+	}
+}
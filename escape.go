@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc"
+)
+
+// エスケープの入力状態
+const (
+	escapeStateNormal = iota
+	escapeStateTilde
+	escapeStateCommand
+)
+
+const escapeHelp = "サポートしているエスケープ(行頭で入力):\r\n" +
+	"~.  切断\r\n" +
+	"~C  コマンド入力(put local [remote] / get remote [local])\r\n" +
+	"~?  このヘルプ\r\n" +
+	"~~  ~を送信\r\n"
+
+// escapeHandler は対話セッション中の行頭の~から始まるエスケープを処理する
+// 端末はrawモードのため、コマンド入力中のエコーは自前で行う
+type escapeHandler struct {
+	peerConnection *webrtc.PeerConnection
+	done           *sessionDone
+	// ファイル転送のデータチャネルが開くまで待つ時間
+	openTimeout time.Duration
+	state       int
+	lineStart   bool
+	line        []byte
+}
+
+func newEscapeHandler(peerConnection *webrtc.PeerConnection, done *sessionDone, openTimeout time.Duration) *escapeHandler {
+	return &escapeHandler{peerConnection: peerConnection, done: done, openTimeout: openTimeout, lineStart: true}
+}
+
+// filter は標準入力からの入力のうちエスケープを処理し、デバイス側に送信するバイト列を返す
+func (e *escapeHandler) filter(input []byte) []byte {
+	output := []byte{}
+	for _, b := range input {
+		switch e.state {
+		case escapeStateNormal:
+			if b == '~' && e.lineStart {
+				e.state = escapeStateTilde
+				continue
+			}
+			output = append(output, b)
+			e.lineStart = b == '\r' || b == '\n'
+		case escapeStateTilde:
+			e.state = escapeStateNormal
+			switch b {
+			case '.':
+				e.done.fail()
+			case 'C':
+				e.state = escapeStateCommand
+				e.line = nil
+				fmt.Fprint(os.Stderr, "\r\ninventory-terminal> ")
+			case '?':
+				fmt.Fprint(os.Stderr, "\r\n"+escapeHelp)
+			case '~':
+				output = append(output, b)
+				e.lineStart = false
+			default:
+				output = append(output, '~', b)
+				e.lineStart = b == '\r' || b == '\n'
+			}
+		case escapeStateCommand:
+			switch b {
+			case '\r', '\n':
+				e.state = escapeStateNormal
+				e.lineStart = true
+				fmt.Fprint(os.Stderr, "\r\n")
+				err := e.runCommand(string(e.line))
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s\r\n", err)
+				}
+			case 0x7f, 0x08:
+				if len(e.line) > 0 {
+					e.line = e.line[:len(e.line)-1]
+					fmt.Fprint(os.Stderr, "\b \b")
+				}
+			case 0x03:
+				// Ctrl-Cで入力を取り消す
+				e.state = escapeStateNormal
+				e.lineStart = true
+				fmt.Fprint(os.Stderr, "\r\n")
+			default:
+				e.line = append(e.line, b)
+				os.Stderr.Write([]byte{b})
+			}
+		}
+	}
+	return output
+}
+
+// runCommand は~Cで入力したコマンドを実行する
+// 転送が終わるまで標準入力の読み込みを止める
+func (e *escapeHandler) runCommand(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	if len(fields) < 2 || len(fields) > 3 {
+		return errors.New("usage: put local [remote] / get remote [local]")
+	}
+	source := fields[1]
+	destination := ""
+	if len(fields) == 3 {
+		destination = fields[2]
+	}
+	switch fields[0] {
+	case transferTypePut:
+		return putFile(e.peerConnection, e.done, e.openTimeout, source, destination, printProgress(filepath.Base(source)))
+	case transferTypeGet:
+		return getFile(e.peerConnection, e.done, e.openTimeout, source, destination, printProgress(filepath.Base(source)))
+	default:
+		return errors.New("usage: put local [remote] / get remote [local]")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEscapeHandlerFilter(t *testing.T) {
+	tests := []struct {
+		name       string
+		inputs     []string
+		want       string
+		wantFailed bool
+	}{
+		{name: "plain", inputs: []string{"ls -l\r"}, want: "ls -l\r"},
+		{name: "tilde inside line", inputs: []string{"echo a~b\r"}, want: "echo a~b\r"},
+		{name: "disconnect", inputs: []string{"~."}, want: "", wantFailed: true},
+		{name: "disconnect after newline", inputs: []string{"ls\r~."}, want: "ls\r", wantFailed: true},
+		{name: "disconnect split across reads", inputs: []string{"ls\r", "~", "."}, want: "ls\r", wantFailed: true},
+		{name: "tilde inside line is not escape", inputs: []string{"ls~."}, want: "ls~."},
+		{name: "double tilde", inputs: []string{"~~."}, want: "~."},
+		{name: "unknown escape", inputs: []string{"~x\r"}, want: "~x\r"},
+		{name: "tilde then newline", inputs: []string{"~\r~."}, want: "~\r", wantFailed: true},
+		{name: "help", inputs: []string{"~?ls\r"}, want: "ls\r"},
+		{name: "empty command", inputs: []string{"~C\rls\r"}, want: "ls\r"},
+		{name: "command is not sent", inputs: []string{"~Cfoo\r"}, want: ""},
+		{name: "command with backspace", inputs: []string{"~Cfo\x7fo\x08\r"}, want: ""},
+		{name: "cancel command", inputs: []string{"~Cput a\x03~."}, want: "", wantFailed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			done := newSessionDone()
+			escape := newEscapeHandler(nil, done, time.Second)
+			output := []byte{}
+			for _, input := range test.inputs {
+				output = append(output, escape.filter([]byte(input))...)
+			}
+			if string(output) != test.want {
+				t.Errorf("output = %q, want %q", output, test.want)
+			}
+			if done.failed() != test.wantFailed {
+				t.Errorf("failed = %t, want %t", done.failed(), test.wantFailed)
+			}
+		})
+	}
+}
+
+func TestEscapeHandlerCommandLine(t *testing.T) {
+	escape := newEscapeHandler(nil, newSessionDone(), time.Second)
+	escape.filter([]byte("~Cgex\x7ft"))
+	if escape.state != escapeStateCommand {
+		t.Fatalf("state = %d, want %d", escape.state, escapeStateCommand)
+	}
+	if string(escape.line) != "get" {
+		t.Fatalf("line = %q, want %q", escape.line, "get")
+	}
+}
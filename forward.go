@@ -0,0 +1,662 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pion/webrtc"
+)
+
+// ポート転送のデータチャネルのラベルの接頭辞
+// TCP接続1つにつきデータチャネルを1つ使用する
+// forwardはPC側からデバイス側の"forward:<接続先のhost:port>"への転送
+// reverseはデバイス側の"reverse:<待受アドレス>"からPC側への転送で、接続先はPC側の設定から決める
+const (
+	forwardChannelLabelPrefix = "forward:"
+	reverseChannelLabelPrefix = "reverse:"
+)
+
+// portForward はポート転送の待受アドレスと接続先アドレス
+type portForward struct {
+	listenAddress string
+	targetAddress string
+}
+
+// portForwardFlags は[bind:]port:host:portの複数指定を受け付ける
+// bindを省略した場合はlocalhostで待ち受ける
+// IPv6アドレスは[::1]のように角括弧で囲んで指定する
+type portForwardFlags []portForward
+
+func (f *portForwardFlags) String() string {
+	forwards := []string{}
+	for _, forward := range *f {
+		forwards = append(forwards, forward.listenAddress+":"+forward.targetAddress)
+	}
+	return strings.Join(forwards, " ")
+}
+
+func (f *portForwardFlags) Set(value string) error {
+	fields, err := splitAddressFields(value)
+	if err != nil {
+		return err
+	}
+	bind := "localhost"
+	switch len(fields) {
+	case 3:
+	case 4:
+		bind = fields[0]
+		fields = fields[1:]
+	default:
+		return errors.New("port forward must be [bind:]port:host:port")
+	}
+	if !isValidPort(fields[0]) || !isValidPort(fields[2]) {
+		return errors.New("invalid port in port forward")
+	}
+	if fields[1] == "" {
+		return errors.New("port forward target host is empty")
+	}
+	*f = append(*f, portForward{
+		listenAddress: net.JoinHostPort(bind, fields[0]),
+		targetAddress: net.JoinHostPort(fields[1], fields[2])})
+	return nil
+}
+
+// splitAddressFields は:区切りのアドレスの指定をフィールドに分割する
+// [::1]のように角括弧で囲んだフィールドは:を含んでいても1つのフィールドとし、角括弧を取り除く
+func splitAddressFields(value string) ([]string, error) {
+	fields := []string{}
+	for {
+		if strings.HasPrefix(value, "[") {
+			end := strings.Index(value, "]")
+			if end < 0 {
+				return nil, errors.New("missing ']' in address")
+			}
+			fields = append(fields, value[1:end])
+			value = value[end+1:]
+			if value == "" {
+				return fields, nil
+			}
+			if !strings.HasPrefix(value, ":") {
+				return nil, errors.New("unexpected character after ']' in address")
+			}
+			value = value[1:]
+			continue
+		}
+		index := strings.Index(value, ":")
+		if index < 0 {
+			return append(fields, value), nil
+		}
+		fields = append(fields, value[:index])
+		value = value[index+1:]
+	}
+}
+
+// isValidPort はportが0から65535の数字であるかを返す
+func isValidPort(port string) bool {
+	_, err := strconv.ParseUint(port, 10, 16)
+	return err == nil
+}
+
+// parseListenAddress は[bind:]portを待受アドレスに変換する
+// bindを省略した場合はlocalhostで待ち受ける
+// IPv6アドレスは[::1]のように角括弧で囲んで指定する
+func parseListenAddress(value string) (string, error) {
+	fields, err := splitAddressFields(value)
+	if err != nil {
+		return "", err
+	}
+	bind := "localhost"
+	switch len(fields) {
+	case 1:
+	case 2:
+		bind = fields[0]
+		fields = fields[1:]
+	default:
+		return "", errors.New("listen address must be [bind:]port")
+	}
+	if !isValidPort(fields[0]) {
+		return "", errors.New("invalid port in listen address")
+	}
+	return net.JoinHostPort(bind, fields[0]), nil
+}
+
+// startLocalForward はローカルのポートで待ち受け、接続ごとにデータチャネルを作成してデバイス側に転送する
+func startLocalForward(peerConnection *webrtc.PeerConnection, forward portForward) error {
+	listener, err := net.Listen("tcp", forward.listenAddress)
+	if err != nil {
+		return fmt.Errorf("fail to listen %s", forward.listenAddress)
+	}
+	go func() {
+		defer listener.Close()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			dataChannel, err := peerConnection.CreateDataChannel(forwardChannelLabelPrefix+forward.targetAddress, nil)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "fail to create forward channel")
+				conn.Close()
+				continue
+			}
+			bridgeDataChannel(dataChannel, func() (io.ReadWriteCloser, error) { return conn, nil })
+		}
+	}()
+	return nil
+}
+
+// startRemoteForward はデバイス側のポートで待ち受け、接続ごとにデータチャネルを作成してPC側に転送する
+func startRemoteForward(peerConnection *webrtc.PeerConnection, listenAddress string) error {
+	listener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return fmt.Errorf("fail to listen %s on device", listenAddress)
+	}
+	go func() {
+		defer listener.Close()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			dataChannel, err := peerConnection.CreateDataChannel(reverseChannelLabelPrefix+listenAddress, nil)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "fail to create reverse forward channel")
+				conn.Close()
+				continue
+			}
+			bridgeDataChannel(dataChannel, func() (io.ReadWriteCloser, error) { return conn, nil })
+		}
+	}()
+	return nil
+}
+
+// acceptReverseForwardChannel はリバース転送のデータチャネルであれば、待受アドレスに対応する接続先に接続して中継する
+// 設定にない待受アドレスのデータチャネルは閉じる
+func acceptReverseForwardChannel(dataChannel *webrtc.DataChannel, forwards portForwardFlags) bool {
+	if !strings.HasPrefix(dataChannel.Label(), reverseChannelLabelPrefix) {
+		return false
+	}
+	targetAddress, ok := reverseForwardTarget(dataChannel.Label(), forwards)
+	if !ok {
+		dataChannel.Close()
+		return true
+	}
+	bridgeDataChannel(dataChannel, func() (io.ReadWriteCloser, error) {
+		return net.Dial("tcp", targetAddress)
+	})
+	return true
+}
+
+// reverseForwardTarget はリバース転送のデータチャネルのラベルの待受アドレスに対応する接続先を返す
+// 設定にない待受アドレスの場合はfalseを返す
+func reverseForwardTarget(label string, forwards portForwardFlags) (string, bool) {
+	listenAddress := strings.TrimPrefix(label, reverseChannelLabelPrefix)
+	for _, forward := range forwards {
+		if forward.listenAddress == listenAddress {
+			return forward.targetAddress, true
+		}
+	}
+	return "", false
+}
+
+// acceptForwardChannel はポート転送のデータチャネルであれば接続先に接続して中継する
+func acceptForwardChannel(dataChannel *webrtc.DataChannel) bool {
+	if !strings.HasPrefix(dataChannel.Label(), forwardChannelLabelPrefix) {
+		return false
+	}
+	targetAddress := strings.TrimPrefix(dataChannel.Label(), forwardChannelLabelPrefix)
+	bridgeDataChannel(dataChannel, func() (io.ReadWriteCloser, error) {
+		return net.Dial("tcp", targetAddress)
+	})
+	return true
+}
+
+// 中継のフロー制御
+// 送信側は書き込みを通知(ack)されていないバイト数がbridgeWindowSizeを超えないように待つため、受信側のキューもこの大きさで収まる
+// また、データチャネルの送信バッファがbridgeBufferedAmountHighを超えた場合はbridgeBufferedAmountLowまで減るのを待つ
+// 送受信するテキストのメッセージはcontrol.goで定義する
+const (
+	bridgeWindowSize         = 1024 * 1024
+	bridgeBufferedAmountHigh = 1024 * 1024
+	bridgeBufferedAmountLow  = 256 * 1024
+	bridgeReadSize           = 16384
+)
+
+// 接続に失敗した理由の種類
+const (
+	dialErrorRefused            = "refused"
+	dialErrorHostUnreachable    = "host-unreachable"
+	dialErrorNetworkUnreachable = "network-unreachable"
+	dialErrorFailed             = "failed"
+)
+
+// bridgeDialError はデータチャネルの相手側で接続先に接続できなかったことを表す
+// detailは相手側のエラーのメッセージ
+type bridgeDialError struct {
+	kind   string
+	detail string
+}
+
+func (e *bridgeDialError) Error() string {
+	if e.detail == "" {
+		return "fail to connect on remote side: " + e.kind
+	}
+	return "fail to connect on remote side: " + e.kind + ": " + e.detail
+}
+
+// parseBridgeError は"error:<種類>:<詳細>"のメッセージを接続のエラーに変換する
+func parseBridgeError(message string) (*bridgeDialError, bool) {
+	if !strings.HasPrefix(message, bridgeErrorPrefix) {
+		return nil, false
+	}
+	fields := strings.SplitN(strings.TrimPrefix(message, bridgeErrorPrefix), ":", 2)
+	dialErr := &bridgeDialError{kind: fields[0]}
+	if len(fields) == 2 {
+		dialErr.detail = fields[1]
+	}
+	return dialErr, true
+}
+
+// dialErrorKind は接続のエラーを通知する種類に変換する
+func dialErrorKind(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return dialErrorRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return dialErrorNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return dialErrorHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return dialErrorHostUnreachable
+	default:
+		return dialErrorFailed
+	}
+}
+
+// bridgeDataChannel はdialで得た接続とデータチャネルの間でバイト列を中継する
+// 片方向の終端はeofで相手に通知して接続の送信側だけを閉じ、両方向が終端に達するかデータチャネルが閉じられた場合に接続も閉じる
+// 受信したバイト列はOnMessageを止めないようにキューに入れ、別のgoroutineで接続に書き込む
+func bridgeDataChannel(dataChannel *webrtc.DataChannel, dial func() (io.ReadWriteCloser, error)) {
+	bridgeDataChannelWithDialResult(dataChannel, dial, nil)
+}
+
+// bridgeDataChannelWithDialResult はbridgeDataChannelと同様に中継し、相手側の接続の結果をdialResultChに通知する
+// 結果が届く前にデータチャネルが閉じた場合はエラーを通知する
+// dialの中で結果を待つことで、結果が届くまでに受信したデータはキューで待たせる
+func bridgeDataChannelWithDialResult(dataChannel *webrtc.DataChannel, dial func() (io.ReadWriteCloser, error), dialResultCh chan error) {
+	stream := newBridgeStream(dataChannel)
+	openCh := make(chan struct{})
+	var openOnce sync.Once
+	dataChannel.OnOpen(func() {
+		openOnce.Do(func() { close(openCh) })
+	})
+	if dataChannel.ReadyState() == webrtc.DataChannelStateOpen {
+		openOnce.Do(func() { close(openCh) })
+	}
+	var closeOnce sync.Once
+	notifyDialResult := func(err error) {
+		if dialResultCh == nil {
+			return
+		}
+		select {
+		case dialResultCh <- err:
+		default:
+		}
+	}
+	closeBridge := func() {
+		closeOnce.Do(func() {
+			stream.close()
+			notifyDialResult(errors.New("forward channel is closed"))
+		})
+	}
+	dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		message, err := stream.receive(msg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			closeBridge()
+			dataChannel.Close()
+			return
+		}
+		if message == bridgeConnectedMessage {
+			notifyDialResult(nil)
+		} else if dialErr, ok := parseBridgeError(message); ok {
+			notifyDialResult(dialErr)
+		}
+	})
+	dataChannel.OnClose(closeBridge)
+
+	go func() {
+		conn, err := dial()
+		select {
+		case <-openCh:
+		case <-stream.closedCh:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			// 相手側の接続の失敗はdialResultChで受け取った呼び出し側が表示する
+			if _, ok := err.(*bridgeDialError); !ok {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			dataChannel.SendText(bridgeErrorPrefix + dialErrorKind(err) + ":" + err.Error())
+			closeBridge()
+			dataChannel.Close()
+			return
+		}
+		defer conn.Close()
+		err = dataChannel.SendText(bridgeConnectedMessage)
+		if err != nil {
+			closeBridge()
+			dataChannel.Close()
+			return
+		}
+		// 相手から終端を受信した場合は接続の送信側だけを閉じ、接続から読み込みを続ける
+		writeDone := make(chan struct{})
+		go func() {
+			defer close(writeDone)
+			err := stream.copyTo(conn)
+			if err == nil && !stream.isClosed() {
+				closeConnWrite(conn)
+				return
+			}
+			conn.Close()
+		}()
+
+		buf := make([]byte, bridgeReadSize)
+		for {
+			var readLen int
+			readLen, err = conn.Read(buf)
+			if err != nil {
+				break
+			}
+			_, err = stream.Write(buf[:readLen])
+			if err != nil {
+				break
+			}
+		}
+		// 接続の終端は相手に通知し、相手からの終端を受信するまでデータチャネルを閉じない
+		if err == io.EOF {
+			err = stream.closeWrite()
+		}
+		if err != nil {
+			closeBridge()
+		}
+		<-writeDone
+		closeBridge()
+		dataChannel.Close()
+	}()
+}
+
+// closeConnWrite はconnの送信側だけを閉じ、相手に終端を通知する
+// net.PipeのようにCloseWriteを持たない接続は全体を閉じる
+func closeConnWrite(conn io.ReadWriteCloser) error {
+	if closeWriter, ok := conn.(interface{ CloseWrite() error }); ok {
+		return closeWriter.CloseWrite()
+	}
+	return conn.Close()
+}
+
+// bridgeStream はデータチャネルでバイト列をフロー制御しながら送受信する
+// 受信したバイト列はOnMessageを止めないようにキューに入れ、copyToを呼んだgoroutineで書き込む
+// 送信はWriteで行い、相手の受信キューとデータチャネルの送信バッファに空きができるまで待つ
+type bridgeStream struct {
+	dataChannel         *webrtc.DataChannel
+	queue               *bridgeQueue
+	window              *bridgeWindow
+	bufferedAmountLowCh chan struct{}
+	closedCh            chan struct{}
+	closeOnce           sync.Once
+}
+
+func newBridgeStream(dataChannel *webrtc.DataChannel) *bridgeStream {
+	s := &bridgeStream{
+		dataChannel:         dataChannel,
+		queue:               newBridgeQueue(bridgeWindowSize),
+		window:              newBridgeWindow(bridgeWindowSize),
+		bufferedAmountLowCh: watchBufferedAmountLow(dataChannel),
+		closedCh:            make(chan struct{}),
+	}
+	return s
+}
+
+// receive は受信したバイト列をキューに追加し、ackと終端の通知を処理する
+// それ以外のテキストのメッセージは処理せずに返す
+func (s *bridgeStream) receive(msg webrtc.DataChannelMessage) (string, error) {
+	if !msg.IsString {
+		return "", s.queue.push(msg.Data)
+	}
+	message := string(msg.Data)
+	if message == bridgeEOFMessage {
+		// 終端より前に受信したバイト列はcopyToで書き込んでから終了する
+		s.queue.close()
+		return "", nil
+	}
+	acked, ok := parseBridgeAck(message)
+	if ok {
+		s.window.release(acked)
+		return "", nil
+	}
+	return message, nil
+}
+
+// Write はpをbridgeReadSizeずつに分割して送信する
+// 送信中に中継が終了した場合はエラーを返す
+func (s *bridgeStream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n := len(p) - written
+		if n > bridgeReadSize {
+			n = bridgeReadSize
+		}
+		if !s.window.acquire(n) || !waitBufferedAmountLow(s.dataChannel, s.bufferedAmountLowCh, s.closedCh) {
+			return written, errors.New("data channel is closed")
+		}
+		err := s.dataChannel.Send(p[written : written+n])
+		if err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// closeWrite は送信するバイト列の終端を相手に通知する
+// 同じデータチャネルで送るため、相手はそれまでに送信したバイト列をすべて受信してから終端を受け取る
+func (s *bridgeStream) closeWrite() error {
+	return s.dataChannel.SendText(bridgeEOFMessage)
+}
+
+// copyTo は受信したバイト列をwに書き込み、書き込んだバイト数をackで相手に通知する
+// 終端を受信するか中継が終了し、受信済みのバイト列をすべて書き込んだ場合はnilを返す
+// データチャネルが閉じた後もキューに残ったバイト列は書き込むため、ackの送信の失敗は無視する
+func (s *bridgeStream) copyTo(w io.Writer) error {
+	for {
+		data, ok := s.queue.pop()
+		if !ok {
+			return nil
+		}
+		_, err := w.Write(data)
+		if err != nil {
+			return err
+		}
+		s.dataChannel.SendText(bridgeAckPrefix + strconv.Itoa(len(data)))
+	}
+}
+
+// isClosed はcloseを呼んだかを返す
+func (s *bridgeStream) isClosed() bool {
+	select {
+	case <-s.closedCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// close は送受信を終了する
+// 送信を待っているWriteはエラーを返し、copyToはキューに残ったバイト列を書き込んでから終了する
+func (s *bridgeStream) close() {
+	s.closeOnce.Do(func() {
+		close(s.closedCh)
+		s.queue.close()
+		s.window.close()
+	})
+}
+
+// watchBufferedAmountLow はデータチャネルの送信バッファがbridgeBufferedAmountLowまで減ったことを通知するチャネルを返す
+// データチャネルごとに1回だけ呼ぶ
+func watchBufferedAmountLow(dataChannel *webrtc.DataChannel) chan struct{} {
+	bufferedAmountLowCh := make(chan struct{}, 1)
+	dataChannel.SetBufferedAmountLowThreshold(bridgeBufferedAmountLow)
+	dataChannel.OnBufferedAmountLow(func() {
+		select {
+		case bufferedAmountLowCh <- struct{}{}:
+		default:
+		}
+	})
+	return bufferedAmountLowCh
+}
+
+// waitBufferedAmountLow はデータチャネルの送信バッファがbridgeBufferedAmountHigh以下になるまで待つ
+// 待っている間にclosedChが閉じた場合はfalseを返す
+func waitBufferedAmountLow(dataChannel *webrtc.DataChannel, bufferedAmountLowCh, closedCh <-chan struct{}) bool {
+	for dataChannel.BufferedAmount() > bridgeBufferedAmountHigh {
+		select {
+		case <-bufferedAmountLowCh:
+		case <-closedCh:
+			return false
+		}
+	}
+	return true
+}
+
+// parseBridgeAck は"ack:<バイト数>"のメッセージからバイト数を取り出す
+func parseBridgeAck(message string) (int, bool) {
+	if !strings.HasPrefix(message, bridgeAckPrefix) {
+		return 0, false
+	}
+	acked, err := strconv.Atoi(strings.TrimPrefix(message, bridgeAckPrefix))
+	if err != nil || acked < 0 {
+		return 0, false
+	}
+	return acked, true
+}
+
+// bridgeQueue はデータチャネルから受信したバイト列を接続に書き込むまで保持する
+// pushはブロックせず、保持するバイト数がlimitを超える場合はエラーを返す
+type bridgeQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	chunks [][]byte
+	size   int
+	limit  int
+	closed bool
+}
+
+func newBridgeQueue(limit int) *bridgeQueue {
+	q := &bridgeQueue{limit: limit}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push はdataの複製をキューに追加する
+// 閉じた後に受信したデータは捨てる
+func (q *bridgeQueue) push(data []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	if q.size+len(data) > q.limit {
+		return errors.New("forward receive window exceeded")
+	}
+	q.chunks = append(q.chunks, append([]byte(nil), data...))
+	q.size += len(data)
+	q.cond.Signal()
+	return nil
+}
+
+// pop はキューの先頭のバイト列を取り出す
+// 空の場合は追加されるまで待ち、閉じられて空になった場合はfalseを返す
+func (q *bridgeQueue) pop() ([]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.chunks) == 0 {
+		if q.closed {
+			return nil, false
+		}
+		q.cond.Wait()
+	}
+	data := q.chunks[0]
+	q.chunks = q.chunks[1:]
+	q.size -= len(data)
+	return data, true
+}
+
+// close はキューを閉じる
+// 閉じる前に追加されたバイト列はpopで取り出せる
+func (q *bridgeQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// bridgeWindow は送信したが相手から書き込みを通知されていないバイト数を管理する
+type bridgeWindow struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	unacked int
+	size    int
+	closed  bool
+}
+
+func newBridgeWindow(size int) *bridgeWindow {
+	w := &bridgeWindow{size: size}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// acquire はnバイトを送信できるようになるまで待つ
+// 待っている間に閉じられた場合はfalseを返す
+func (w *bridgeWindow) acquire(n int) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for !w.closed && w.unacked > 0 && w.unacked+n > w.size {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return false
+	}
+	w.unacked += n
+	return true
+}
+
+// release は相手が書き込んだnバイトを送信可能な量に戻す
+func (w *bridgeWindow) release(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.unacked -= n
+	if w.unacked < 0 {
+		w.unacked = 0
+	}
+	w.cond.Broadcast()
+}
+
+func (w *bridgeWindow) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	w.cond.Broadcast()
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc"
+)
+
+func TestPortForwardFlagsSet(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    portForward
+		wantErr bool
+	}{
+		{value: "8080:localhost:80", want: portForward{listenAddress: "localhost:8080", targetAddress: "localhost:80"}},
+		{value: "0.0.0.0:8080:192.168.1.10:80", want: portForward{listenAddress: "0.0.0.0:8080", targetAddress: "192.168.1.10:80"}},
+		{value: ":8080:localhost:80", want: portForward{listenAddress: ":8080", targetAddress: "localhost:80"}},
+		{value: "2222:[::1]:22", want: portForward{listenAddress: "localhost:2222", targetAddress: "[::1]:22"}},
+		{value: "[::1]:2222:localhost:22", want: portForward{listenAddress: "[::1]:2222", targetAddress: "localhost:22"}},
+		{value: "[::]:8080:[fe80::1%eth0]:80", want: portForward{listenAddress: "[::]:8080", targetAddress: "[fe80::1%eth0]:80"}},
+		{value: "8080", wantErr: true},
+		{value: "8080:localhost", wantErr: true},
+		{value: "a:b:c:d:e", wantErr: true},
+		{value: "2222:::1:22", wantErr: true},
+		{value: "2222:[::1:22", wantErr: true},
+		{value: "2222:[::1]x:22", wantErr: true},
+		{value: "http:localhost:80", wantErr: true},
+		{value: "8080:localhost:70000", wantErr: true},
+		{value: "8080::80", wantErr: true},
+	}
+	for _, test := range tests {
+		forwards := portForwardFlags{}
+		err := forwards.Set(test.value)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: want error, got %+v", test.value, forwards)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(forwards, portForwardFlags{test.want}) {
+			t.Errorf("%s: forwards = %+v, want %+v", test.value, forwards, test.want)
+		}
+	}
+}
+
+func TestParseBridgeAck(t *testing.T) {
+	tests := []struct {
+		message string
+		want    int
+		wantOK  bool
+	}{
+		{message: "ack:16384", want: 16384, wantOK: true},
+		{message: "ack:0", want: 0, wantOK: true},
+		{message: "ack:-1"},
+		{message: "ack:"},
+		{message: "connected"},
+	}
+	for _, test := range tests {
+		got, ok := parseBridgeAck(test.message)
+		if got != test.want || ok != test.wantOK {
+			t.Errorf("%s: got %d, %t, want %d, %t", test.message, got, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestParseBridgeError(t *testing.T) {
+	tests := []struct {
+		message string
+		want    *bridgeDialError
+	}{
+		{message: "error:refused:dial tcp 127.0.0.1:22: connect: connection refused", want: &bridgeDialError{kind: dialErrorRefused, detail: "dial tcp 127.0.0.1:22: connect: connection refused"}},
+		{message: "error:failed:fail to start sftp server: chdir /home/pi: no such file or directory", want: &bridgeDialError{kind: dialErrorFailed, detail: "fail to start sftp server: chdir /home/pi: no such file or directory"}},
+		{message: "error:host-unreachable", want: &bridgeDialError{kind: dialErrorHostUnreachable}},
+		{message: "connected"},
+		{message: "ack:10"},
+	}
+	for _, test := range tests {
+		got, ok := parseBridgeError(test.message)
+		if ok != (test.want != nil) || (ok && *got != *test.want) {
+			t.Errorf("%s: got %+v, %t, want %+v", test.message, got, ok, test.want)
+		}
+	}
+}
+
+func TestBridgeQueue(t *testing.T) {
+	queue := newBridgeQueue(10)
+	data := []byte("abcd")
+	err := queue.push(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pushしたバイト列は複製して保持する
+	data[0] = 'x'
+	err = queue.push([]byte("efgh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = queue.push([]byte("ijk"))
+	if err == nil {
+		t.Fatal("want error for data exceeding limit")
+	}
+	queue.close()
+	// 閉じた後のデータは捨て、閉じる前のデータは取り出せる
+	err = queue.push([]byte("lmn"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"abcd", "efgh"} {
+		got, ok := queue.pop()
+		if !ok || string(got) != want {
+			t.Fatalf("pop = %q, %t, want %q", got, ok, want)
+		}
+	}
+	_, ok := queue.pop()
+	if ok {
+		t.Fatal("pop must return false after close")
+	}
+}
+
+func TestBridgeQueuePopWaits(t *testing.T) {
+	queue := newBridgeQueue(10)
+	popped := make(chan string)
+	go func() {
+		data, _ := queue.pop()
+		popped <- string(data)
+	}()
+	select {
+	case data := <-popped:
+		t.Fatalf("pop returned %q before push", data)
+	case <-time.After(50 * time.Millisecond):
+	}
+	queue.push([]byte("abc"))
+	select {
+	case data := <-popped:
+		if data != "abc" {
+			t.Fatalf("pop = %q, want %q", data, "abc")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pop did not return after push")
+	}
+}
+
+// TCP接続は送信側だけを閉じ、相手からの読み込みを続けられる
+func TestCloseConnWriteTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// 終端まで読み込んでから応答する
+		ioutil.ReadAll(conn)
+		conn.Write([]byte("response"))
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("request"))
+	err = closeConnWrite(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	response, err := ioutil.ReadAll(conn)
+	if err != nil || string(response) != "response" {
+		t.Fatalf("response = %q, %v, want %q", response, err, "response")
+	}
+}
+
+// CloseWriteを持たない接続は全体を閉じる
+func TestCloseConnWritePipe(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	err := closeConnWrite(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("read must fail after closeConnWrite")
+	}
+}
+
+func TestBridgeWindow(t *testing.T) {
+	window := newBridgeWindow(10)
+	if !window.acquire(8) {
+		t.Fatal("acquire must succeed within window")
+	}
+	acquired := make(chan bool)
+	go func() {
+		acquired <- window.acquire(4)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquire must wait while window is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	window.release(8)
+	select {
+	case ok := <-acquired:
+		if !ok {
+			t.Fatal("acquire must succeed after release")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("acquire did not return after release")
+	}
+
+	// 送信待ちの間に閉じた場合はfalseを返す
+	go func() {
+		acquired <- window.acquire(10)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	window.close()
+	select {
+	case ok := <-acquired:
+		if ok {
+			t.Fatal("acquire must fail after close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("acquire did not return after close")
+	}
+}
+
+func TestParseListenAddress(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "1080", want: "localhost:1080"},
+		{value: "0.0.0.0:1080", want: "0.0.0.0:1080"},
+		{value: ":1080", want: ":1080"},
+		{value: "[::1]:2022", want: "[::1]:2022"},
+		{value: "[::]:2022", want: "[::]:2022"},
+		{value: "::1:2022", wantErr: true},
+		{value: "[::1]", wantErr: true},
+		{value: "localhost:", wantErr: true},
+		{value: "socks", wantErr: true},
+		{value: "a:b:1080", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseListenAddress(test.value)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: want error, got %s", test.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.value, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: address = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+func TestReverseForwardTarget(t *testing.T) {
+	forwards := portForwardFlags{
+		{listenAddress: "localhost:8080", targetAddress: "localhost:80"},
+		{listenAddress: "0.0.0.0:2222", targetAddress: "192.168.1.10:22"},
+	}
+	tests := []struct {
+		label  string
+		want   string
+		wantOK bool
+	}{
+		{label: "reverse:localhost:8080", want: "localhost:80", wantOK: true},
+		{label: "reverse:0.0.0.0:2222", want: "192.168.1.10:22", wantOK: true},
+		{label: "reverse:localhost:9090"},
+		{label: "reverse:"},
+		{label: "reverse:localhost:80"},
+	}
+	for _, test := range tests {
+		got, ok := reverseForwardTarget(test.label, forwards)
+		if got != test.want || ok != test.wantOK {
+			t.Errorf("reverseForwardTarget(%q) = %q, %v, want %q, %v", test.label, got, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+// gatherTestCandidates はICE候補の収集が終わると収集した候補を通知する
+// SetLocalDescriptionの前に呼ぶ
+func gatherTestCandidates(peerConnection *webrtc.PeerConnection) <-chan []webrtc.ICECandidateInit {
+	candidatesCh := make(chan []webrtc.ICECandidateInit, 1)
+	candidates := []webrtc.ICECandidateInit{}
+	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			candidatesCh <- candidates
+			return
+		}
+		candidates = append(candidates, candidate.ToJSON())
+	})
+	return candidatesCh
+}
+
+// newTestPeerConnectionPair は同じプロセス内で接続した2つのPeerConnectionを作成する
+// setupはofferの作成前に呼び、offer側でデータチャネルを作成する
+func newTestPeerConnectionPair(t *testing.T, setup func(offerer, answerer *webrtc.PeerConnection)) {
+	offerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { offerer.Close() })
+	answerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { answerer.Close() })
+	setup(offerer, answerer)
+
+	offererCandidatesCh := gatherTestCandidates(offerer)
+	answererCandidatesCh := gatherTestCandidates(answerer)
+	offer, err := offerer.CreateOffer(nil)
+	if err == nil {
+		err = offerer.SetLocalDescription(offer)
+	}
+	if err == nil {
+		err = answerer.SetRemoteDescription(offer)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := answerer.CreateAnswer(nil)
+	if err == nil {
+		err = answerer.SetLocalDescription(answer)
+	}
+	if err == nil {
+		err = offerer.SetRemoteDescription(answer)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, candidate := range <-offererCandidatesCh {
+		answerer.AddICECandidate(candidate)
+	}
+	for _, candidate := range <-answererCandidatesCh {
+		offerer.AddICECandidate(candidate)
+	}
+}
+
+// PC側で接続先に接続できない場合は失敗の理由をデータチャネルで送り返す
+func TestAcceptReverseForwardChannelDialFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddress := listener.Addr().String()
+	listener.Close()
+	forwards := portForwardFlags{{listenAddress: "localhost:8080", targetAddress: closedAddress}}
+
+	messageCh := make(chan string, 1)
+	newTestPeerConnectionPair(t, func(offerer, answerer *webrtc.PeerConnection) {
+		answerer.OnDataChannel(func(dataChannel *webrtc.DataChannel) {
+			if !acceptReverseForwardChannel(dataChannel, forwards) {
+				t.Errorf("label %q is not accepted", dataChannel.Label())
+			}
+		})
+		dataChannel, err := offerer.CreateDataChannel(reverseChannelLabelPrefix+"localhost:8080", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
+			if msg.IsString {
+				select {
+				case messageCh <- string(msg.Data):
+				default:
+				}
+			}
+		})
+	})
+
+	select {
+	case message := <-messageCh:
+		if !strings.HasPrefix(message, bridgeErrorPrefix+dialErrorRefused+":") {
+			t.Fatalf("message = %q, want %q", message, bridgeErrorPrefix+dialErrorRefused+":<detail>")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("dial failure is not sent back")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pion/webrtc"
+)
+
+// iceConfig はICEサーバーとICEの経路選択の設定
+// 設定ファイル(JSON)と--ice-server、--ice-transport-policyで指定する
+type iceConfig struct {
+	ICEServers         []iceServerConfig `json:"iceServers"`
+	ICETransportPolicy string            `json:"iceTransportPolicy"`
+}
+
+type iceServerConfig struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username"`
+	Credential string   `json:"credential"`
+}
+
+// iceServerFlags は--ice-server url[,username,credential]の複数指定を受け付ける
+type iceServerFlags []iceServerConfig
+
+func (f *iceServerFlags) String() string {
+	urls := []string{}
+	for _, server := range *f {
+		urls = append(urls, server.URLs...)
+	}
+	return strings.Join(urls, " ")
+}
+
+func (f *iceServerFlags) Set(value string) error {
+	fields := strings.Split(value, ",")
+	switch len(fields) {
+	case 1:
+		*f = append(*f, iceServerConfig{URLs: []string{fields[0]}})
+	case 3:
+		*f = append(*f, iceServerConfig{URLs: []string{fields[0]}, Username: fields[1], Credential: fields[2]})
+	default:
+		return errors.New("ice server must be url or url,username,credential")
+	}
+	return nil
+}
+
+// args は指定されたICEサーバーを--ice-serverの引数に戻す
+// 引数は実行可能リソースのスクリプトやプロセスの引数として他から読めるため、認証情報を含むICEサーバーはエラーにする
+func (f *iceServerFlags) args() ([]string, error) {
+	args := []string{}
+	for _, server := range *f {
+		if server.Username != "" || server.Credential != "" {
+			return nil, errors.New("TURN credentials can not be passed to device mode with --ice-server: write them in the config file")
+		}
+		for _, url := range server.URLs {
+			args = append(args, "--ice-server", url)
+		}
+	}
+	return args, nil
+}
+
+// loadICEConfig は設定ファイルを読み込む
+// requiredがfalseの場合はファイルが存在しなければ空の設定を返す
+func loadICEConfig(path string, required bool) (*iceConfig, error) {
+	config := &iceConfig{}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			return config, nil
+		}
+		return nil, errors.New("fail to read config: " + path)
+	}
+	err = json.Unmarshal(buf, config)
+	if err != nil {
+		return nil, errors.New("fail to parse config: " + path)
+	}
+	return config, nil
+}
+
+// webrtcConfiguration はwebrtc.Configurationに変換する
+// ICEサーバーが指定されていない場合はデフォルトのSTUNサーバーを使用する
+func (c *iceConfig) webrtcConfiguration() (webrtc.Configuration, error) {
+	config := webrtc.Configuration{}
+	for _, server := range c.ICEServers {
+		iceServer := webrtc.ICEServer{URLs: server.URLs}
+		if server.Username != "" || server.Credential != "" {
+			iceServer.Username = server.Username
+			iceServer.Credential = server.Credential
+			iceServer.CredentialType = webrtc.ICECredentialTypePassword
+		}
+		config.ICEServers = append(config.ICEServers, iceServer)
+	}
+	if len(config.ICEServers) == 0 {
+		config.ICEServers = []webrtc.ICEServer{{URLs: []string{stunServer}}}
+	}
+	switch c.ICETransportPolicy {
+	case "", "all":
+		config.ICETransportPolicy = webrtc.ICETransportPolicyAll
+	case "relay":
+		config.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	default:
+		return config, errors.New("invalid ice transport policy (all/relay)")
+	}
+	return config, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pion/webrtc"
+)
+
+// 認証情報を含むICEサーバーはdeviceモードの引数に戻さない
+func TestICEServerFlagsSet(t *testing.T) {
+	tests := []struct {
+		values      []string
+		want        iceServerFlags
+		wantArgs    []string
+		wantArgsErr bool
+		wantErr     bool
+	}{
+		{
+			values:   []string{"stun:stun.example.com:3478"},
+			want:     iceServerFlags{{URLs: []string{"stun:stun.example.com:3478"}}},
+			wantArgs: []string{"--ice-server", "stun:stun.example.com:3478"},
+		},
+		{
+			values:      []string{"turn:turn.example.com:3478,user,pass"},
+			want:        iceServerFlags{{URLs: []string{"turn:turn.example.com:3478"}, Username: "user", Credential: "pass"}},
+			wantArgsErr: true,
+		},
+		{
+			values: []string{"stun:stun.example.com:3478", "turn:turn.example.com:3478"},
+			want: iceServerFlags{
+				{URLs: []string{"stun:stun.example.com:3478"}},
+				{URLs: []string{"turn:turn.example.com:3478"}}},
+			wantArgs: []string{"--ice-server", "stun:stun.example.com:3478", "--ice-server", "turn:turn.example.com:3478"},
+		},
+		{
+			values: []string{"stun:stun.example.com:3478", "turn:turn.example.com:3478,user,pass"},
+			want: iceServerFlags{
+				{URLs: []string{"stun:stun.example.com:3478"}},
+				{URLs: []string{"turn:turn.example.com:3478"}, Username: "user", Credential: "pass"}},
+			wantArgsErr: true,
+		},
+		{values: []string{"turn:turn.example.com:3478,user"}, wantErr: true},
+		{values: []string{"turn:turn.example.com:3478,user,pass,extra"}, wantErr: true},
+	}
+	for _, test := range tests {
+		flags := iceServerFlags{}
+		var err error
+		for _, value := range test.values {
+			err = flags.Set(value)
+			if err != nil {
+				break
+			}
+		}
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%v: want error", test.values)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.values, err)
+			continue
+		}
+		if !reflect.DeepEqual(flags, test.want) {
+			t.Errorf("%v: flags = %+v, want %+v", test.values, flags, test.want)
+		}
+		args, err := flags.args()
+		if test.wantArgsErr {
+			if err == nil {
+				t.Errorf("%v: args = %v, want error", test.values, args)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(args, test.wantArgs) {
+			t.Errorf("%v: args = %v, %v, want %v", test.values, args, err, test.wantArgs)
+		}
+	}
+}
+
+func TestWebrtcConfiguration(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  iceConfig
+		want    webrtc.Configuration
+		wantErr bool
+	}{
+		{
+			name: "default",
+			want: webrtc.Configuration{
+				ICEServers:         []webrtc.ICEServer{{URLs: []string{stunServer}}},
+				ICETransportPolicy: webrtc.ICETransportPolicyAll},
+		},
+		{
+			name: "turn relay",
+			config: iceConfig{
+				ICEServers: []iceServerConfig{
+					{URLs: []string{"stun:stun.example.com:3478"}},
+					{URLs: []string{"turn:turn.example.com:3478"}, Username: "user", Credential: "pass"}},
+				ICETransportPolicy: "relay"},
+			want: webrtc.Configuration{
+				ICEServers: []webrtc.ICEServer{
+					{URLs: []string{"stun:stun.example.com:3478"}},
+					{URLs: []string{"turn:turn.example.com:3478"}, Username: "user", Credential: "pass", CredentialType: webrtc.ICECredentialTypePassword}},
+				ICETransportPolicy: webrtc.ICETransportPolicyRelay},
+		},
+		{
+			name:   "all",
+			config: iceConfig{ICETransportPolicy: "all"},
+			want: webrtc.Configuration{
+				ICEServers:         []webrtc.ICEServer{{URLs: []string{stunServer}}},
+				ICETransportPolicy: webrtc.ICETransportPolicyAll},
+		},
+		{name: "invalid policy", config: iceConfig{ICETransportPolicy: "none"}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.config.webrtcConfiguration()
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("configuration = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"time"
 
 	"github.com/pion/webrtc"
 )
@@ -16,6 +17,7 @@ const (
 	modelsPath      string = "models"
 	bootstrapServer string = "bootstrap.soracom.io:5683"
 	stunServer      string = "stun:stun.l.google.com:19302"
+	defaultEndpoint string = "inventory-terminal"
 )
 
 func main() {
@@ -23,10 +25,42 @@ func main() {
 	dispVersion := false
 	var mode string
 	var endpoint string
+	var apiEndpoint string
+	var coverage string
+	var profileName string
+	var listenAddr string
+	var format string
+	var target string
+	var sftpListen string
+	var deviceID string
+	tags := tagFlags{}
+	var signalingTimeout time.Duration
+	var configPath string
+	var iceServers iceServerFlags
+	var iceTransportPolicy string
+	var localForwards portForwardFlags
+	var remoteForwards portForwardFlags
+	var dynamicForwards dynamicForwardFlags
 	flag.BoolVar(&dispVersion, "v", false, "バージョン表示")
 	flag.BoolVar(&dispVersion, "version", false, "バージョン表示")
-	flag.StringVar(&mode, "mode", "client", "モード指定(daemon/client/device)")
-	flag.StringVar(&endpoint, "endpoint", "inventory-terminal", "エンドポイント名")
+	flag.StringVar(&mode, "mode", "client", "モード指定(daemon/client/device/list/mock-api/stdio-proxy/put/get/sftp、sftp-serverはdeviceモードが内部で使用)")
+	flag.StringVar(&endpoint, "endpoint", "", "エンドポイント名(daemonモードの省略時はinventory-terminal、clientモードの省略時は選択)")
+	flag.StringVar(&deviceID, "device-id", "", "接続先のデバイスID")
+	flag.Var(tags, "tag", "接続先デバイスのタグ(key=value、複数指定可)")
+	flag.DurationVar(&signalingTimeout, "signaling-timeout", 2*time.Minute, "シグナリングの各段階の待ち時間")
+	flag.StringVar(&configPath, "config", "", "設定ファイルのパス(省略時は実行ファイルと同じディレクトリのconfig.json)")
+	flag.Var(&iceServers, "ice-server", "ICEサーバー(url または url,username,credential、複数指定可)")
+	flag.StringVar(&iceTransportPolicy, "ice-transport-policy", "", "ICEの経路選択(all/relay)")
+	flag.Var(&localForwards, "L", "ローカルのポートをデバイス側の接続先に転送([bind:]port:host:port、複数指定可)")
+	flag.Var(&remoteForwards, "R", "デバイス側のポートをPC側の接続先に転送([bind:]port:host:port、複数指定可)")
+	flag.Var(&dynamicForwards, "D", "SOCKS5プロキシとして待ち受け、デバイス側から接続([bind:]port、複数指定可)")
+	flag.StringVar(&apiEndpoint, "api-endpoint", "", "SORACOM APIのURL(指定時はcoverageより優先)")
+	flag.StringVar(&coverage, "coverage", "", "カバレッジ指定(jp/g)")
+	flag.StringVar(&profileName, "profile", "", "soracom-cliのプロファイル名")
+	flag.StringVar(&format, "format", "table", "listモードの出力形式(table/json)")
+	flag.StringVar(&target, "target", "127.0.0.1:22", "stdio-proxyモードで接続するデバイス側のアドレス")
+	flag.StringVar(&sftpListen, "sftp-listen", "", "SFTPのために待ち受けるアドレス([bind:]port、clientモードのみ)")
+	flag.StringVar(&listenAddr, "listen", "127.0.0.1:8080", "mock-apiモードの待受アドレス")
 	flag.Parse()
 
 	if dispVersion {
@@ -41,27 +75,140 @@ func main() {
 	}
 	rootDir := filepath.Join(exe, "..")
 
+	// SFTPの待受はclientモードでのみ使用する
+	if sftpListen != "" {
+		if mode != "client" {
+			fmt.Fprintln(os.Stderr, "--sftp-listen is only available in client mode")
+			os.Exit(1)
+		}
+		sftpListen, err = parseListenAddress(sftpListen)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	// ICEの設定はWebRTCで接続するモードでのみ読み込む
+	loadSessionConfig := func() *sessionConfig {
+		var ice *iceConfig
+		if configPath == "" {
+			ice, err = loadICEConfig(filepath.Join(rootDir, "config.json"), false)
+		} else {
+			ice, err = loadICEConfig(configPath, true)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if len(iceServers) > 0 {
+			ice.ICEServers = iceServers
+		}
+		if iceTransportPolicy != "" {
+			ice.ICETransportPolicy = iceTransportPolicy
+		}
+		return &sessionConfig{signalingTimeout: signalingTimeout, ice: ice}
+	}
+	// deviceモードに引き継ぐ引数はdeviceモードを起動するモードでのみ作成する
+	loadDeviceArgs := func() []string {
+		deviceArgs, err := deviceModeArgs(signalingTimeout, configPath, iceServers, iceTransportPolicy)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return deviceArgs
+	}
+
 	switch mode {
 	case "daemon":
-		err = runDaemonMode(endpoint)
+		if endpoint == "" {
+			endpoint = defaultEndpoint
+		}
+		err = runDaemonMode(endpoint, loadDeviceArgs())
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
 	case "client":
-		err = runClientMode(endpoint)
+		config := loadSessionConfig()
+		client, err := setupSoracomClient(profileName, coverage, apiEndpoint)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		exitCode, err := runClientMode(&deviceSelector{endpoint: endpoint, deviceID: deviceID, tags: tags}, client, config, &clientOptions{command: flag.Args(), localForwards: localForwards, remoteForwards: remoteForwards, dynamicForwards: dynamicForwards, sftpListen: sftpListen})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(exitCode)
+	case "stdio-proxy":
+		config := loadSessionConfig()
+		client, err := setupSoracomClient(profileName, coverage, apiEndpoint)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		err = runStdioProxyMode(&deviceSelector{endpoint: endpoint, deviceID: deviceID, tags: tags}, client, config, forwardChannelLabelPrefix+target)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "sftp":
+		config := loadSessionConfig()
+		client, err := setupSoracomClient(profileName, coverage, apiEndpoint)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		err = runStdioProxyMode(&deviceSelector{endpoint: endpoint, deviceID: deviceID, tags: tags}, client, config, sftpChannelLabel)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "put", "get":
+		config := loadSessionConfig()
+		client, err := setupSoracomClient(profileName, coverage, apiEndpoint)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		err = runTransferMode(&deviceSelector{endpoint: endpoint, deviceID: deviceID, tags: tags}, client, config, mode, flag.Args())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "list":
+		client, err := setupSoracomClient(profileName, coverage, apiEndpoint)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		err = runListMode(client, format)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
 	case "device":
-		err = runDeviceMode(rootDir)
+		err = runDeviceMode(rootDir, loadSessionConfig())
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
+	case "mock-api":
+		if endpoint == "" {
+			endpoint = defaultEndpoint
+		}
+		err = runMockAPIMode(endpoint, listenAddr, loadDeviceArgs())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "sftp-server":
+		// deviceモードがSFTPのセッションごとにホームディレクトリで起動する
+		serveSFTP(&stdioConn{onClose: func() {}})
 	case "execute":
-		cmd := exec.Command(exe, "--mode", "device")
+		// daemonモードで指定した引数は実行可能リソースのスクリプトでexecuteモードに渡される
+		cmd := exec.Command(exe, append([]string{"--mode", "device"}, loadDeviceArgs()...)...)
 		cmd.Start()
 		os.Exit(0)
 	default:
@@ -73,11 +220,79 @@ func main() {
 	}
 }
 
-func createPeerConnection() (*webrtc.PeerConnection, error) {
-	config := webrtc.Configuration{ICEServers: []webrtc.ICEServer{{URLs: []string{stunServer}}}}
+// deviceModeArgs はdaemonモードからexecuteモードを経由してdeviceモードに引き継ぐ引数を返す
+// 設定ファイルのパスは作業ディレクトリに依存しないよう絶対パスにする
+// TURNサーバーの認証情報は引数に含めず、設定ファイルから読み込ませる
+func deviceModeArgs(signalingTimeout time.Duration, configPath string, iceServers iceServerFlags, iceTransportPolicy string) ([]string, error) {
+	args := []string{"--signaling-timeout", signalingTimeout.String()}
+	if configPath != "" {
+		absPath, err := filepath.Abs(configPath)
+		if err != nil {
+			return nil, errors.New("fail to resolve config path: " + configPath)
+		}
+		args = append(args, "--config", absPath)
+	}
+	iceServerArgs, err := iceServers.args()
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, iceServerArgs...)
+	if iceTransportPolicy != "" {
+		args = append(args, "--ice-transport-policy", iceTransportPolicy)
+	}
+	return args, nil
+}
+
+// sessionConfig はクライアントとデバイスに共通の接続設定
+type sessionConfig struct {
+	signalingTimeout time.Duration
+	ice              *iceConfig
+}
+
+func createPeerConnection(ice *iceConfig) (*webrtc.PeerConnection, error) {
+	config, err := ice.webrtcConfiguration()
+	if err != nil {
+		return nil, err
+	}
 	peerConnection, err := webrtc.NewPeerConnection(config)
 	if err != nil {
 		return nil, errors.New("fail to create webrtc connection")
 	}
 	return peerConnection, nil
 }
+
+// setupSoracomClient はプロファイル、カバレッジ、URLの指定からSORACOM APIのクライアントを生成する
+func setupSoracomClient(profileName, coverage, apiEndpoint string) (*soracomClient, error) {
+	var profile *soracomProfile
+	var err error
+	if profileName != "" {
+		profile, err = loadSoracomProfile(profileName)
+		if err != nil {
+			return nil, err
+		}
+		if coverage == "" {
+			coverage = profile.CoverageType
+		}
+		if apiEndpoint == "" {
+			apiEndpoint = profile.Endpoint
+		}
+	}
+	apiEndpoint, err = resolveAPIEndpoint(coverage, apiEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	client := newSoracomClient(apiEndpoint)
+	// 対話入力の場合もメールアドレスごとにトークンをキャッシュするため、メールアドレスのみ先に入力する
+	identity, email := credentialIdentity(profile)
+	client.credentialFunc = func() (*soracomCredential, error) {
+		return getCredential(profile, email)
+	}
+	if identity == "" {
+		return client, nil
+	}
+	client.tokenCache, err = newTokenCache(client.apiEndpoint, identity)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return client, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/1stship/inventoryd"
+)
+
+const (
+	mockDeviceID   string = "d-mock"
+	mockApiKey     string = "api-mock"
+	mockOperatorId string = "OP-mock"
+	mockToken      string = "token-mock"
+)
+
+// mockAPIServer はSORACOM APIのうちinventory-terminalが使用する部分をローカルのresourcesディレクトリで模擬する
+// デバイス一覧はdevicesを返し、リソースの読み書きはmockDeviceIDのデバイスのみ受け付ける
+type mockAPIServer struct {
+	endpoint     string
+	resourcesDir string
+	devices      []inventoryDevice
+}
+
+func newMockAPIServer(endpoint, resourcesDir string) *mockAPIServer {
+	server := &mockAPIServer{endpoint: endpoint, resourcesDir: resourcesDir}
+	server.devices = []inventoryDevice{*server.device()}
+	return server
+}
+
+func runMockAPIMode(endpoint, listenAddr string, deviceArgs []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.New("fail to get executable path")
+	}
+	rootDir := filepath.Join(exe, "..")
+	config := &inventoryd.Config{EndpointClientName: endpoint, RootPath: rootDir}
+	err = createDefaultFiles(config, deviceArgs)
+	if err != nil {
+		return err
+	}
+	server := newMockAPIServer(endpoint, filepath.Join(rootDir, resourcePath))
+	fmt.Printf("mock API server listening on http://%s\n", listenAddr)
+	return http.ListenAndServe(listenAddr, server)
+}
+
+func (s *mockAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	paths := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(paths) < 2 || paths[0] != "v1" {
+		s.writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if paths[1] == "auth" && len(paths) == 2 && r.Method == "POST" {
+		s.handleAuth(w, r)
+		return
+	}
+	if r.Header.Get("X-Soracom-Api-Key") != mockApiKey || r.Header.Get("X-Soracom-Token") != mockToken {
+		s.writeError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+	if paths[1] != "devices" {
+		s.writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	switch {
+	case len(paths) == 2 && r.Method == "GET":
+		s.handleDevices(w, r)
+	case len(paths) == 3 && paths[2] == mockDeviceID && r.Method == "GET":
+		s.writeJson(w, s.device())
+	case len(paths) == 6 && paths[2] == mockDeviceID && (r.Method == "GET" || r.Method == "PUT"):
+		s.handleResource(w, r, paths[3], paths[4], paths[5])
+	case len(paths) == 7 && paths[2] == mockDeviceID && paths[6] == "execute" && r.Method == "POST":
+		s.handleExecute(w, r, paths[3], paths[4], paths[5])
+	default:
+		s.writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *mockAPIServer) handleAuth(w http.ResponseWriter, r *http.Request) {
+	s.writeJson(w, &soracomToken{ApiKey: mockApiKey, OperatorId: mockOperatorId, Token: mockToken})
+}
+
+// handleDevices はlimitとlast_evaluated_keyでページングし、続きがある場合はX-Soracom-Next-Keyに最後のデバイスIDを返す
+func (s *mockAPIServer) handleDevices(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	start := 0
+	lastEvaluatedKey := query.Get("last_evaluated_key")
+	if lastEvaluatedKey != "" {
+		start = len(s.devices)
+		for i, device := range s.devices {
+			if device.DeviceId == lastEvaluatedKey {
+				start = i + 1
+				break
+			}
+		}
+	}
+	end := len(s.devices)
+	if query.Get("limit") != "" {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 {
+			s.writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		if start+limit < end {
+			end = start + limit
+		}
+	}
+	page := s.devices[start:end]
+	if end < len(s.devices) {
+		w.Header().Set("X-Soracom-Next-Key", page[len(page)-1].DeviceId)
+	}
+	s.writeJson(w, page)
+}
+
+func (s *mockAPIServer) device() *inventoryDevice {
+	return &inventoryDevice{DeviceId: mockDeviceID, Endpoint: s.endpoint, Online: true}
+}
+
+func (s *mockAPIServer) handleResource(w http.ResponseWriter, r *http.Request, objectID, instanceID, resourceID string) {
+	resourceFilePath, err := s.resourceFilePath(objectID, instanceID, resourceID)
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if r.Method == "PUT" {
+		var value valueJson
+		err := json.NewDecoder(r.Body).Decode(&value)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "invalid value")
+			return
+		}
+		err = ioutil.WriteFile(resourceFilePath, []byte(value.Value), 0644)
+		if err != nil {
+			s.writeError(w, http.StatusInternalServerError, "fail to write resource")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	value, err := ioutil.ReadFile(resourceFilePath)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "fail to read resource")
+		return
+	}
+	id, _ := strconv.Atoi(resourceID)
+	rawValue, _ := json.Marshal(string(value))
+	s.writeJson(w, &inventoryResource{Id: id, Type: "string", Value: rawValue})
+}
+
+func (s *mockAPIServer) handleExecute(w http.ResponseWriter, r *http.Request, objectID, instanceID, resourceID string) {
+	resourceFilePath, err := s.resourceFilePath(objectID, instanceID, resourceID)
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	// inventorydと同様に実行可能リソースのスクリプトを実行する
+	err = exec.Command("/bin/bash", resourceFilePath).Run()
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "fail to execute resource")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *mockAPIServer) resourceFilePath(objectID, instanceID, resourceID string) (string, error) {
+	for _, id := range []string{objectID, instanceID, resourceID} {
+		if _, err := strconv.Atoi(id); err != nil {
+			return "", errors.New("invalid resource path")
+		}
+	}
+	resourceFilePath := filepath.Join(s.resourcesDir, objectID, instanceID, resourceID)
+	_, err := os.Stat(resourceFilePath)
+	if err != nil {
+		return "", errors.New("resource not found")
+	}
+	return resourceFilePath, nil
+}
+
+func (s *mockAPIServer) writeJson(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+func (s *mockAPIServer) writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestMockAPIServer はシグナリングに使用するリソースファイルを一時ディレクトリに作成してモックを起動する
+func newTestMockAPIServer(t *testing.T) (*mockAPIServer, *httptest.Server, string) {
+	resourcesDir := t.TempDir()
+	resourceIDs := []int{offerResourceID, reasonResourceID, answerResourceID, startResourceID, statusResourceID, notifyResourceID, clientCandidateResourceID}
+	for i := 0; i < signalingInstanceCount; i++ {
+		instanceDirPath := filepath.Join(resourcesDir, "9", strconv.Itoa(i))
+		err := os.MkdirAll(instanceDirPath, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, resourceID := range resourceIDs {
+			err := ioutil.WriteFile(filepath.Join(instanceDirPath, strconv.Itoa(resourceID)), []byte{}, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	server := newMockAPIServer("inventory-terminal", resourcesDir)
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	return server, httpServer, resourcesDir
+}
+
+func newTestSoracomClient(t *testing.T, apiEndpoint string) *soracomClient {
+	client := newSoracomClient(apiEndpoint)
+	err := client.auth(&soracomCredential{Email: "test@example.com", Password: "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestMockDevicesPaging(t *testing.T) {
+	server, httpServer, _ := newTestMockAPIServer(t)
+	server.devices = []inventoryDevice{{DeviceId: "d-1"}, {DeviceId: "d-2"}, {DeviceId: "d-3"}}
+	client := newTestSoracomClient(t, httpServer.URL)
+	tests := []struct {
+		query   string
+		wantIDs []string
+		wantKey string
+	}{
+		{query: "", wantIDs: []string{"d-1", "d-2", "d-3"}},
+		{query: "limit=2", wantIDs: []string{"d-1", "d-2"}, wantKey: "d-2"},
+		{query: "limit=2&last_evaluated_key=d-2", wantIDs: []string{"d-3"}},
+		{query: "limit=1&last_evaluated_key=d-1", wantIDs: []string{"d-2"}, wantKey: "d-2"},
+		{query: "last_evaluated_key=d-3", wantIDs: []string{}},
+	}
+	for _, test := range tests {
+		buf, header, err := client.requestWithHeader("GET", "/v1/devices?"+test.query, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", test.query, err)
+		}
+		var page []inventoryDevice
+		err = json.Unmarshal(buf, &page)
+		if err != nil {
+			t.Fatalf("%s: %v", test.query, err)
+		}
+		ids := []string{}
+		for _, device := range page {
+			ids = append(ids, device.DeviceId)
+		}
+		if !reflect.DeepEqual(ids, test.wantIDs) {
+			t.Errorf("%s: ids = %v, want %v", test.query, ids, test.wantIDs)
+		}
+		if key := header.Get("X-Soracom-Next-Key"); key != test.wantKey {
+			t.Errorf("%s: next key = %q, want %q", test.query, key, test.wantKey)
+		}
+	}
+
+	_, err := client.request("GET", "/v1/devices?limit=0", nil)
+	if err == nil {
+		t.Error("limit=0 must be rejected")
+	}
+}
+
+func TestMockListDevices(t *testing.T) {
+	server, httpServer, _ := newTestMockAPIServer(t)
+	server.devices = nil
+	for i := 0; i < devicesPageSize*2+1; i++ {
+		server.devices = append(server.devices, inventoryDevice{DeviceId: fmt.Sprintf("d-%03d", i)})
+	}
+	client := newTestSoracomClient(t, httpServer.URL)
+	devices, err := client.listDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(devices, server.devices) {
+		t.Fatalf("listDevices returned %d devices, want %d", len(devices), len(server.devices))
+	}
+}
+
+func TestMockSignaling(t *testing.T) {
+	_, httpServer, resourcesDir := newTestMockAPIServer(t)
+	client := newTestSoracomClient(t, httpServer.URL)
+	device, err := client.getDevice(mockDeviceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSignaler := newInventorySignaler(&apiResourceStore{client: client, device: device})
+	deviceSignaler := newInventorySignaler(&fileResourceStore{objectDirPath: filepath.Join(resourcesDir, "9")})
+
+	err = clientSignaler.startSignaling()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		err := deviceSignaler.acceptRequest()
+		if err == nil {
+			err = deviceSignaler.publishOffer(testOffer)
+		}
+		if err == nil {
+			_, err = deviceSignaler.awaitAnswer(ctx)
+		}
+		if err == nil {
+			err = deviceSignaler.publishStatus(signalingStatusAnswered)
+		}
+		errCh <- err
+	}()
+
+	offer, err := clientSignaler.awaitOffer(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offer != testOffer {
+		t.Fatalf("offer = %+v, want %+v", offer, testOffer)
+	}
+	err = clientSignaler.publishAnswer(testAnswer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-errCh
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = clientSignaler.awaitStatus(ctx, signalingStatusAnswered, signalingStatusConnected)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMockRejectsInvalidToken(t *testing.T) {
+	_, httpServer, _ := newTestMockAPIServer(t)
+	resp, err := http.Get(httpServer.URL + "/v1/devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
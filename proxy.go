@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pion/webrtc"
+)
+
+// stdioConn は標準入出力を1つの接続として扱う
+// 閉じた場合はonCloseを呼ぶ
+type stdioConn struct {
+	onClose func()
+}
+
+func (c *stdioConn) Read(p []byte) (int, error) {
+	return os.Stdin.Read(p)
+}
+
+func (c *stdioConn) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+// CloseWrite は標準出力を閉じ、読み込んでいるプロセスに終端を通知する
+func (c *stdioConn) CloseWrite() error {
+	return os.Stdout.Close()
+}
+
+func (c *stdioConn) Close() error {
+	c.onClose()
+	return nil
+}
+
+// runStdioProxyMode は標準入出力をlabelのデータチャネルに中継する
+// ポート転送のラベルを指定した場合はsshのProxyCommandとして、SFTPのラベルを指定した場合はsftp -Dのサーバーとして使用する
+func runStdioProxyMode(selector *deviceSelector, client *soracomClient, config *sessionConfig, label string) error {
+	trickleCtx, cancelTrickle := context.WithTimeout(context.Background(), config.signalingTimeout)
+	defer cancelTrickle()
+	peerConnection, control, done, err := connectWithoutShell(trickleCtx, selector, client, config)
+	if err != nil {
+		return err
+	}
+
+	dataChannel, err := peerConnection.CreateDataChannel(label, nil)
+	if err != nil {
+		return errors.New("fail to create data channel")
+	}
+	// デバイス側で接続先に接続した結果を待ってから標準入出力を中継する
+	dialResultCh := make(chan error, 1)
+	dialErrCh := make(chan *bridgeDialError, 1)
+	bridgeDataChannelWithDialResult(dataChannel, func() (io.ReadWriteCloser, error) {
+		err := <-dialResultCh
+		if err != nil {
+			if dialErr, ok := err.(*bridgeDialError); ok {
+				dialErrCh <- dialErr
+			}
+			done.fail()
+			return nil, err
+		}
+		return &stdioConn{onClose: done.finish}, nil
+	}, dialResultCh)
+	<-done.done()
+	// デバイス側のセッションを終了させる
+	control.send(&controlMessage{Type: controlTypeExit})
+	peerConnection.Close()
+	select {
+	case dialErr := <-dialErrCh:
+		return dialErr
+	default:
+	}
+	if done.failed() {
+		return errors.New("connection to device is lost")
+	}
+	return nil
+}
+
+// connectWithoutShell はシェルを起動せずにデバイスと接続し、制御チャネルが開くまで待つ
+// 終了時は制御チャネルでexitを送信してデバイス側のセッションを終了させる
+func connectWithoutShell(trickleCtx context.Context, selector *deviceSelector, client *soracomClient, config *sessionConfig) (*webrtc.PeerConnection, *controlChannel, *sessionDone, error) {
+	openCh := make(chan bool)
+	done := newSessionDone()
+	var control *controlChannel
+	peerConnection, err := connectDevice(trickleCtx, selector, client, config, done, func(peerConnection *webrtc.PeerConnection) {
+		peerConnection.OnDataChannel(func(dataChannel *webrtc.DataChannel) {
+			if dataChannel.Label() != controlChannelLabel {
+				return
+			}
+			control = newControlChannel(dataChannel)
+			setupControlOnlyChannel(control, dataChannel, openCh, done)
+		})
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	err = waitDataChannelOpen(openCh, done, config.signalingTimeout)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return peerConnection, control, done, nil
+}
+
+// setupControlOnlyChannel はシェルを起動せずにkeepaliveとエラーの通知のみを扱う
+func setupControlOnlyChannel(control *controlChannel, dataChannel *webrtc.DataChannel, openCh chan bool, done *sessionDone) {
+	dataChannel.OnOpen(func() {
+		control.sendHello()
+		control.startKeepAlive(done.fail)
+		openCh <- true
+	})
+	dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		message, err := control.receive(msg)
+		if err != nil {
+			control.sendError(err.Error())
+			return
+		}
+		switch message.Type {
+		case controlTypeHello:
+			err = control.checkHello(message)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				done.fail()
+			}
+		case controlTypeError:
+			fmt.Fprintln(os.Stderr, message.Message)
+			done.fail()
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/pion/webrtc"
+)
+
+// descriptionのエンコード方式(チャンクヘッダのバージョンとして先頭チャンクに書き込む)
+const (
+	// SessionDescriptionのJSON
+	descriptionEncodingJSON = "1"
+	// 不要な行を除いたSDPをdeflateで圧縮してbase64にしたもの
+	descriptionEncodingCompact = "2"
+)
+
+// compactSDPでSDPから除く行の接頭辞
+var strippedSDPLinePrefixes = []string{
+	"a=msid-semantic:",
+	"a=extmap-allow-mixed",
+}
+
+func isSupportedDescriptionEncoding(encoding string) bool {
+	return encoding == descriptionEncodingJSON || encoding == descriptionEncodingCompact
+}
+
+func marshalDescription(description webrtc.SessionDescription, encoding string) ([]byte, error) {
+	switch encoding {
+	case descriptionEncodingJSON:
+		descriptionBytes, err := json.Marshal(description)
+		if err != nil {
+			return nil, errors.New("fail to serialize description")
+		}
+		return descriptionBytes, nil
+	case descriptionEncodingCompact:
+		var buf bytes.Buffer
+		base64Writer := base64.NewEncoder(base64.StdEncoding, &buf)
+		flateWriter, err := flate.NewWriter(base64Writer, flate.BestCompression)
+		if err != nil {
+			return nil, errors.New("fail to compress description")
+		}
+		_, err = flateWriter.Write([]byte(strconv.Itoa(int(description.Type)) + "\n" + compactSDP(description.SDP)))
+		if err == nil {
+			err = flateWriter.Close()
+		}
+		if err == nil {
+			err = base64Writer.Close()
+		}
+		if err != nil {
+			return nil, errors.New("fail to compress description")
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, errors.New("unsupported description encoding")
+}
+
+func unmarshalDescription(data []byte, encoding string) (webrtc.SessionDescription, error) {
+	var description webrtc.SessionDescription
+	switch encoding {
+	case descriptionEncodingJSON:
+		err := json.Unmarshal(data, &description)
+		if err != nil {
+			return description, errors.New("fail to parse description")
+		}
+		return description, nil
+	case descriptionEncodingCompact:
+		base64Reader := base64.NewDecoder(base64.StdEncoding, bytes.NewReader(data))
+		decompressed, err := ioutil.ReadAll(flate.NewReader(base64Reader))
+		if err != nil {
+			return description, errors.New("fail to decompress description")
+		}
+		parts := strings.SplitN(string(decompressed), "\n", 2)
+		if len(parts) != 2 {
+			return description, errors.New("fail to parse description")
+		}
+		sdpType, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return description, errors.New("fail to parse description type")
+		}
+		description.Type = webrtc.SDPType(sdpType)
+		description.SDP = parts[1]
+		return description, nil
+	}
+	return description, errors.New("unsupported description encoding")
+}
+
+// compactSDP は接続に影響しない行を除く
+// ICE候補はリンクローカルアドレスを含めてすべて残す
+func compactSDP(sdp string) string {
+	lines := strings.Split(sdp, "\r\n")
+	compacted := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if isStrippedSDPLine(line) {
+			continue
+		}
+		compacted = append(compacted, line)
+	}
+	return strings.Join(compacted, "\r\n")
+}
+
+func isStrippedSDPLine(line string) bool {
+	for _, prefix := range strippedSDPLinePrefixes {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc"
+)
+
+const testSDP = "v=0\r\n" +
+	"o=- 4215776563421542534 1 IN IP4 0.0.0.0\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"a=msid-semantic: WMS\r\n" +
+	"a=extmap-allow-mixed\r\n" +
+	"m=application 9 DTLS/SCTP 5000\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=candidate:1 1 udp 2130706431 192.168.1.10 50000 typ host\r\n" +
+	"a=candidate:2 1 udp 2130706431 fe80::1 50001 typ host\r\n" +
+	"a=candidate:3 1 udp 1694498815 203.0.113.1 50002 typ srflx raddr 0.0.0.0 rport 50002\r\n" +
+	"a=end-of-candidates\r\n"
+
+func TestCompactSDP(t *testing.T) {
+	compacted := compactSDP(testSDP)
+	for _, prefix := range strippedSDPLinePrefixes {
+		if strings.Contains(compacted, prefix) {
+			t.Errorf("%q is not stripped", prefix)
+		}
+	}
+	for _, line := range strings.Split(testSDP, "\r\n") {
+		if strings.HasPrefix(line, "a=candidate:") && !strings.Contains(compacted, line) {
+			t.Errorf("candidate %q is dropped", line)
+		}
+	}
+}
+
+func TestDescriptionRoundTrip(t *testing.T) {
+	description := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: testSDP}
+	tests := []struct {
+		encoding string
+		want     webrtc.SessionDescription
+	}{
+		{encoding: descriptionEncodingJSON, want: description},
+		{encoding: descriptionEncodingCompact, want: webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: compactSDP(testSDP)}},
+	}
+	for _, test := range tests {
+		data, err := marshalDescription(description, test.encoding)
+		if err != nil {
+			t.Fatalf("encoding %s: %v", test.encoding, err)
+		}
+		decoded, err := unmarshalDescription(data, test.encoding)
+		if err != nil {
+			t.Fatalf("encoding %s: %v", test.encoding, err)
+		}
+		if decoded != test.want {
+			t.Errorf("encoding %s: decoded = %+v, want %+v", test.encoding, decoded, test.want)
+		}
+	}
+}
+
+func TestCompactDescriptionIsSmaller(t *testing.T) {
+	description := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: testSDP}
+	jsonData, err := marshalDescription(description, descriptionEncodingJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compactData, err := marshalDescription(description, descriptionEncodingCompact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compactData) >= len(jsonData) {
+		t.Errorf("compact encoding is %d bytes, json is %d bytes", len(compactData), len(jsonData))
+	}
+}
+
+func TestUnmarshalDescriptionErrors(t *testing.T) {
+	tests := []struct {
+		encoding string
+		data     string
+	}{
+		{encoding: descriptionEncodingJSON, data: "{"},
+		{encoding: descriptionEncodingCompact, data: "not base64!"},
+		{encoding: descriptionEncodingCompact, data: ""},
+		{encoding: "9", data: "{}"},
+	}
+	for _, test := range tests {
+		_, err := unmarshalDescription([]byte(test.data), test.encoding)
+		if err == nil {
+			t.Errorf("encoding %s, data %q: want error", test.encoding, test.data)
+		}
+	}
+}
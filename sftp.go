@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/pion/webrtc"
+	"github.com/pkg/sftp"
+)
+
+// SFTPのデータチャネルのラベル
+// SFTPのセッション1つにつきPC側でデータチャネルを1つ作成する
+const sftpChannelLabel = "sftp"
+
+// acceptSFTPChannel はSFTPのデータチャネルであればデバイス側でSFTPサーバーとして応答する
+func acceptSFTPChannel(dataChannel *webrtc.DataChannel) bool {
+	if dataChannel.Label() != sftpChannelLabel {
+		return false
+	}
+	bridgeDataChannel(dataChannel, startSFTPServerProcess)
+	return true
+}
+
+// startSFTPServerProcess はホームディレクトリを作業ディレクトリとしてsftp-serverモードのプロセスを起動する
+// デバイスモードのプロセスの作業ディレクトリを変えずに、SFTPの相対パスをホームディレクトリからのパスにする
+func startSFTPServerProcess() (io.ReadWriteCloser, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, errors.New("fail to get executable path")
+	}
+	cmd := exec.Command(exe, "--mode", "sftp-server")
+	cmd.Dir = deviceHomeDir()
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.New("fail to start sftp server: " + err.Error())
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.New("fail to start sftp server: " + err.Error())
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, errors.New("fail to start sftp server: " + err.Error())
+	}
+	return &processConn{cmd: cmd, stdin: stdin, stdout: stdout}, nil
+}
+
+// processConn はプロセスの標準入出力を1つの接続として扱う
+// 閉じた場合はプロセスを終了させる
+type processConn struct {
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	stdout    io.ReadCloser
+	closeOnce sync.Once
+}
+
+func (c *processConn) Read(p []byte) (int, error) {
+	return c.stdout.Read(p)
+}
+
+func (c *processConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+// CloseWrite は標準入力を閉じ、プロセスに終端を通知する
+func (c *processConn) CloseWrite() error {
+	return c.stdin.Close()
+}
+
+func (c *processConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stdin.Close()
+		c.cmd.Process.Kill()
+		c.cmd.Wait()
+	})
+	return nil
+}
+
+// serveSFTP はSFTPサーバーを動作させる
+// sftp-serverモードで標準入出力を使用し、相対パスはプロセスの作業ディレクトリからのパスになる
+func serveSFTP(conn io.ReadWriteCloser) {
+	defer conn.Close()
+	server, err := sftp.NewServer(conn)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fail to start sftp server")
+		return
+	}
+	defer server.Close()
+	err = server.Serve()
+	if err != nil && err != io.EOF {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// startSFTPListener はローカルのポートで待ち受け、接続ごとにSFTPのデータチャネルを作成して中継する
+// sshfsのdirectportなど、SFTPを直接TCPで話すクライアントから接続する
+func startSFTPListener(peerConnection *webrtc.PeerConnection, listenAddress string) error {
+	listener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return fmt.Errorf("fail to listen %s", listenAddress)
+	}
+	go func() {
+		defer listener.Close()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			dataChannel, err := peerConnection.CreateDataChannel(sftpChannelLabel, nil)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "fail to create sftp channel")
+				conn.Close()
+				continue
+			}
+			bridgeDataChannel(dataChannel, func() (io.ReadWriteCloser, error) { return conn, nil })
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc"
+)
+
+// シグナリングの状態(9/0/7に書き込まれる値)
+// デバイス側が書き込み、クライアント側が参照する
+// idle、offering、answered、connected、idleの順に遷移し、失敗した場合はfailed(理由を9/0/1に書き込む)に遷移する
+// 別のセッションが接続中に開始された場合は9/0/7を変更せず、busyを9/1/1で開始を要求したクライアントにのみ通知する
+const (
+	signalingStatusIdle      = 0
+	signalingStatusOffering  = 1
+	signalingStatusAnswered  = 2
+	signalingStatusConnected = 3
+	signalingStatusFailed    = 4
+)
+
+// シグナリングに使用するSORACOM Inventoryのリソース(オブジェクト9)
+const (
+	offerResourceID  = 0
+	answerResourceID = 3
+	startResourceID  = 4
+	statusResourceID = 7
+	notifyResourceID = 14
+
+	// 状態の詳細を書き込むリソース
+	// "<リクエストID>:<失敗理由>"の形式で、状態を書き込む前に書き込む
+	// User Name(9/x/14)はAPIから読み出せないため、読み出し可能なリソース(PkgVersion)のインスタンス0を使用する
+	reasonInstanceID = 0
+	reasonResourceID = 1
+
+	// クライアントが開始の要求ごとに発行したリクエストIDを書き込むリソース(User Name)
+	// デバイス側は状態の詳細にリクエストIDを含め、クライアント側は自身のリクエストID以外の状態を無視する
+	requestInstanceID = 1
+	requestResourceID = 14
+
+	// busyを通知するリソース
+	// 接続中のセッションの状態を上書きしないよう、9/0/7とは別に拒否したリクエストIDを書き込む
+	busyInstanceID = 1
+	busyResourceID = 1
+
+	// trickle ICEの候補を書き込むリソース
+	// デバイス側の候補はPkgVersionのインスタンス2以降、クライアント側の候補はPasswordに書き込む
+	deviceCandidateResourceID      = 1
+	deviceCandidateFirstInstanceID = 2
+	clientCandidateResourceID      = 15
+	clientCandidateFirstInstanceID = 0
+
+	// 1インスタンスに書き込むdescriptionの最大長と、descriptionに使用するインスタンス数
+	descriptionChunkSize   = 800
+	signalingInstanceCount = 16
+)
+
+// signaler はWebRTCのoffer/answerを交換するシグナリング経路
+// デバイス側はacceptRequest/publishOffer/awaitAnswer/publishStatus/publishFailure/publishBusy、
+// クライアント側はstartSignaling/awaitOffer/publishAnswer/awaitStatusを使用する
+// publishCandidates/awaitCandidatesはtrickle ICEのために両側で使用する
+type signaler interface {
+	// acceptRequestは開始を要求したクライアントのリクエストIDを読み出す
+	acceptRequest() error
+	publishOffer(offer webrtc.SessionDescription) error
+	awaitAnswer(ctx context.Context) (webrtc.SessionDescription, error)
+	publishStatus(status int) error
+	publishFailure(reason string) error
+	// publishBusyは別のセッションが接続中であることを要求したクライアントにのみ通知する
+	publishBusy() error
+
+	startSignaling() error
+	awaitOffer(ctx context.Context) (webrtc.SessionDescription, error)
+	publishAnswer(answer webrtc.SessionDescription) error
+	// awaitStatusは自身のリクエストに対する状態がいずれかになるまで待つ
+	// デバイスがfailedまたはbusyになった場合は理由を含むエラーを返す
+	awaitStatus(ctx context.Context, statuses ...int) error
+
+	// publishCandidatesはそれまでに収集したICE候補をすべて書き込む
+	// completeは候補の収集が完了したこと(end-of-candidates)を表す
+	publishCandidates(candidates []webrtc.ICECandidateInit, complete bool) error
+	// awaitCandidatesは相手のICE候補を受信するたびにonCandidateを呼び出し、相手の収集が完了したら戻る
+	awaitCandidates(ctx context.Context, onCandidate func(candidate webrtc.ICECandidateInit)) error
+}
+
+// リソースの値を待つ際の確認間隔
+const (
+	pollInitialInterval   time.Duration = 500 * time.Millisecond
+	pollMaxInterval       time.Duration = 5 * time.Second
+	pollBackoffFactor     float64       = 1.5
+	watchFallbackInterval time.Duration = 10 * time.Second
+)
+
+// resourceStore はSORACOM Inventoryのリソースの読み書きを行う
+// デバイス側はローカルのリソースファイル、クライアント側はSORACOM APIを使用する
+type resourceStore interface {
+	readResource(instanceID, resourceID int) (string, error)
+	writeResource(instanceID, resourceID int, value string) error
+	executeResource(instanceID, resourceID int) error
+}
+
+// instanceCounter は作成済みのインスタンス数が分かるresourceStoreが実装する
+// 以前のバージョンで作成したリソースファイルはインスタンスが少ないため、作成済みの範囲のみ使用する
+type instanceCounter interface {
+	instanceCount() int
+}
+
+// resourceWatcher はリソースの変更を通知できるresourceStoreが実装する
+// 変更時にチャネルへ通知し、返した関数で監視を終了する
+type resourceWatcher interface {
+	watchResource(instanceID, resourceID int) (<-chan struct{}, func(), error)
+}
+
+// inventorySignaler はSORACOM Inventoryのリソースを介してシグナリングを行う
+// descriptionは圧縮して書き込み、answerは受信したofferと同じエンコード方式で書き込む
+// offerごとにセッションIDを発行し、同じセッションIDを持たないanswerは無視する
+type inventorySignaler struct {
+	store         resourceStore
+	encoding      string
+	requestID     string
+	sessionID     string
+	isDevice      bool
+	instanceCount int
+}
+
+func newInventorySignaler(store resourceStore) *inventorySignaler {
+	return &inventorySignaler{store: store, encoding: descriptionEncodingCompact, instanceCount: signalingInstanceCountOf(store)}
+}
+
+// signalingInstanceCountOf はstoreでシグナリングに使用できるインスタンス数を返す
+func signalingInstanceCountOf(store resourceStore) int {
+	if counter, ok := store.(instanceCounter); ok && counter.instanceCount() < signalingInstanceCount {
+		return counter.instanceCount()
+	}
+	return signalingInstanceCount
+}
+
+func newSessionID() (string, error) {
+	buf := make([]byte, 8)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", errors.New("fail to generate session id")
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func (s *inventorySignaler) acceptRequest() error {
+	requestID, err := s.store.readResource(requestInstanceID, requestResourceID)
+	if err != nil {
+		return errors.New("fail to read request id")
+	}
+	s.requestID = requestID
+	return nil
+}
+
+func (s *inventorySignaler) publishOffer(offer webrtc.SessionDescription) error {
+	sessionID, err := newSessionID()
+	if err != nil {
+		return err
+	}
+	s.sessionID = sessionID
+	s.isDevice = true
+	err = s.writeDescription(offerResourceID, offer)
+	if err != nil {
+		return errors.New("fail to write offer: " + err.Error())
+	}
+	return s.publishStatus(signalingStatusOffering)
+}
+
+// awaitAnswer は自身のセッションIDのanswerを受信するまで待つ
+// 以前のセッションや別のクライアントのanswerは適用せずに標準エラー出力に報告し、期限まで待ち続ける
+// 期限までに受信できなかった場合は、最後に読み出せなかった理由を含むエラーを返す
+func (s *inventorySignaler) awaitAnswer(ctx context.Context) (webrtc.SessionDescription, error) {
+	lastNotify := ""
+	var lastErr error
+	for {
+		notify, err := s.waitResource(ctx, 0, notifyResourceID, func(value string) bool {
+			return value == s.sessionID || (value != "" && value != lastNotify)
+		})
+		if err != nil {
+			return webrtc.SessionDescription{}, answerTimeoutError(lastErr)
+		}
+		if notify != s.sessionID {
+			lastNotify = notify
+			lastErr = errors.New("answer of another session is ignored")
+			s.publishReason("stale answer " + notify)
+			continue
+		}
+		answer, header, err := s.readDescription(answerResourceID)
+		if err == nil {
+			if header.sessionID == s.sessionID {
+				return answer, nil
+			}
+			err = errors.New("answer of another session is ignored")
+			s.publishReason("stale answer " + header.sessionID)
+		}
+		lastErr = err
+		// 書き込み途中の場合は少し待って再確認する
+		select {
+		case <-ctx.Done():
+			return webrtc.SessionDescription{}, answerTimeoutError(lastErr)
+		case <-time.After(pollInitialInterval):
+		}
+	}
+}
+
+// answerTimeoutError はanswerを受信できずに期限を過ぎた場合のエラーを返す
+func answerTimeoutError(lastErr error) error {
+	if lastErr == nil {
+		return errors.New("timeout to recv answer")
+	}
+	return errors.New("timeout to recv answer: " + lastErr.Error())
+}
+
+func (s *inventorySignaler) publishStatus(status int) error {
+	return s.writeStatus(status, "")
+}
+
+// publishFailure は失敗理由を書き込んでからfailedに遷移する
+func (s *inventorySignaler) publishFailure(reason string) error {
+	return s.writeStatus(signalingStatusFailed, reason)
+}
+
+// publishReason は状態を変えずにリクエストIDと理由を書き込む
+// 別のセッションのanswerを無視したことを、タイムアウトを待たずに状態のリソースから確認できるようにする
+func (s *inventorySignaler) publishReason(reason string) error {
+	err := s.store.writeResource(reasonInstanceID, reasonResourceID, s.requestID+":"+reason)
+	if err != nil {
+		return errors.New("fail to update status reason")
+	}
+	return nil
+}
+
+// writeStatus はリクエストIDと失敗理由を書き込んでから状態を書き込む
+// クライアント側は状態を読み出した後に詳細を読み出すため、この順序であれば古い状態を自身のものと誤認しない
+func (s *inventorySignaler) writeStatus(status int, reason string) error {
+	err := s.publishReason(reason)
+	if err != nil {
+		return err
+	}
+	err = s.store.writeResource(0, statusResourceID, strconv.Itoa(status))
+	if err != nil {
+		return errors.New("fail to update status")
+	}
+	return nil
+}
+
+func (s *inventorySignaler) publishBusy() error {
+	err := s.store.writeResource(busyInstanceID, busyResourceID, s.requestID)
+	if err != nil {
+		return errors.New("fail to notify busy")
+	}
+	return nil
+}
+
+// startSignaling はリクエストIDを書き込んでからデバイス側のプロセスを起動する
+func (s *inventorySignaler) startSignaling() error {
+	requestID, err := newSessionID()
+	if err != nil {
+		return err
+	}
+	s.requestID = requestID
+	err = s.store.writeResource(requestInstanceID, requestResourceID, requestID)
+	if err != nil {
+		return errors.New("fail to write request id")
+	}
+	return s.store.executeResource(0, startResourceID)
+}
+
+func (s *inventorySignaler) awaitOffer(ctx context.Context) (webrtc.SessionDescription, error) {
+	var offer webrtc.SessionDescription
+	err := s.awaitStatus(ctx, signalingStatusOffering)
+	if err != nil {
+		return offer, err
+	}
+	offer, header, err := s.readDescription(offerResourceID)
+	if err != nil {
+		return offer, errors.New("fail to read offer: " + err.Error())
+	}
+	s.sessionID = header.sessionID
+	return offer, nil
+}
+
+func (s *inventorySignaler) publishAnswer(answer webrtc.SessionDescription) error {
+	err := s.writeDescription(answerResourceID, answer)
+	if err != nil {
+		return err
+	}
+	return s.store.writeResource(0, notifyResourceID, s.sessionID)
+}
+
+func (s *inventorySignaler) awaitStatus(ctx context.Context, statuses ...int) error {
+	expected := map[string]bool{strconv.Itoa(signalingStatusFailed): true}
+	for _, status := range statuses {
+		expected[strconv.Itoa(status)] = true
+	}
+	// 以前のセッションの状態や、別のクライアントへのbusyの通知は無視する
+	reason := ""
+	busy := false
+	value, err := s.waitResource(ctx, 0, statusResourceID, func(value string) bool {
+		if expected[value] {
+			detail, err := s.store.readResource(reasonInstanceID, reasonResourceID)
+			if err == nil && strings.HasPrefix(detail, s.requestID+":") {
+				reason = strings.TrimPrefix(detail, s.requestID+":")
+				return true
+			}
+		}
+		busyRequestID, err := s.store.readResource(busyInstanceID, busyResourceID)
+		busy = err == nil && busyRequestID == s.requestID
+		return busy
+	})
+	if err != nil {
+		return errors.New("timeout to wait signaling status")
+	}
+	if busy {
+		return errors.New("device is busy: another session is in progress")
+	}
+	if value == strconv.Itoa(signalingStatusFailed) {
+		if reason == "" {
+			reason = "unknown reason"
+		}
+		return errors.New("device failed: " + reason)
+	}
+	return nil
+}
+
+// waitResource は指定したリソースの値がmatchを満たすまで待ち、その値を返す
+// storeがresourceWatcherを実装していればリソースの変更を契機に、そうでなければ指数バックオフで確認する
+func (s *inventorySignaler) waitResource(ctx context.Context, instanceID, resourceID int, match func(value string) bool) (string, error) {
+	var changed <-chan struct{}
+	if watcher, ok := s.store.(resourceWatcher); ok {
+		ch, stop, err := watcher.watchResource(instanceID, resourceID)
+		if err == nil {
+			changed = ch
+			defer stop()
+		}
+	}
+	interval := pollInitialInterval
+	for {
+		value, err := s.store.readResource(instanceID, resourceID)
+		if err == nil && match(value) {
+			return value, nil
+		}
+		if changed != nil {
+			// 変更通知を取りこぼした場合に備えて一定間隔でも確認する
+			interval = watchFallbackInterval
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-changed:
+		case <-time.After(interval):
+			if changed == nil {
+				interval = nextPollInterval(interval)
+			}
+		}
+	}
+}
+
+// nextPollInterval は指数バックオフで次の確認までの間隔を返す
+func nextPollInterval(interval time.Duration) time.Duration {
+	interval = time.Duration(float64(interval) * pollBackoffFactor)
+	if interval > pollMaxInterval {
+		return pollMaxInterval
+	}
+	return interval
+}
+
+// candidateList はtrickle ICEで書き込むICE候補の一覧
+type candidateList struct {
+	Candidates []webrtc.ICECandidateInit `json:"candidates"`
+	Complete   bool                      `json:"complete"`
+}
+
+func (s *inventorySignaler) publishCandidates(candidates []webrtc.ICECandidateInit, complete bool) error {
+	resourceID, firstInstanceID := clientCandidateResourceID, clientCandidateFirstInstanceID
+	if s.isDevice {
+		resourceID, firstInstanceID = deviceCandidateResourceID, deviceCandidateFirstInstanceID
+	}
+	listBytes, err := json.Marshal(&candidateList{Candidates: candidates, Complete: complete})
+	if err != nil {
+		return errors.New("fail to serialize candidates")
+	}
+	return s.writeChunks(resourceID, firstInstanceID, listBytes, descriptionEncodingJSON)
+}
+
+func (s *inventorySignaler) awaitCandidates(ctx context.Context, onCandidate func(candidate webrtc.ICECandidateInit)) error {
+	resourceID, firstInstanceID := deviceCandidateResourceID, deviceCandidateFirstInstanceID
+	if s.isDevice {
+		resourceID, firstInstanceID = clientCandidateResourceID, clientCandidateFirstInstanceID
+	}
+	applied := 0
+	lastValue := ""
+	for {
+		value, err := s.waitResource(ctx, firstInstanceID, resourceID, func(value string) bool {
+			return value != "" && value != lastValue
+		})
+		if err != nil {
+			return err
+		}
+		listBytes, header, err := s.readChunks(resourceID, firstInstanceID)
+		var list candidateList
+		if err == nil && header.sessionID == s.sessionID {
+			err = json.Unmarshal(listBytes, &list)
+		}
+		if err != nil || header.sessionID != s.sessionID {
+			// 書き込み途中や以前のセッションの候補の場合は少し待って再確認する
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(pollInitialInterval):
+			}
+			continue
+		}
+		lastValue = value
+		for ; applied < len(list.Candidates); applied++ {
+			onCandidate(list.Candidates[applied])
+		}
+		if list.Complete {
+			return nil
+		}
+	}
+}
+
+// writeDescription はdescriptionを分割してインスタンス0から順に同一リソースに書き込む
+func (s *inventorySignaler) writeDescription(resourceID int, description webrtc.SessionDescription) error {
+	descriptionBytes, err := marshalDescription(description, s.encoding)
+	if err != nil {
+		return err
+	}
+	return s.writeChunks(resourceID, 0, descriptionBytes, s.encoding)
+}
+
+// readDescription はインスタンス0から順に同一リソースからdescriptionを読み出して結合する
+func (s *inventorySignaler) readDescription(resourceID int) (webrtc.SessionDescription, chunkHeader, error) {
+	descriptionBytes, header, err := s.readChunks(resourceID, 0)
+	if err != nil {
+		return webrtc.SessionDescription{}, header, err
+	}
+	s.encoding = header.version
+	description, err := unmarshalDescription(descriptionBytes, header.version)
+	return description, header, err
+}
+
+// writeChunks はデータを分割してfirstInstanceIDのインスタンスから順に同一リソースに書き込む
+// 読み出し側が先頭チャンクの変更を契機に読み出せるよう、末尾のチャンクから書き込む
+func (s *inventorySignaler) writeChunks(resourceID, firstInstanceID int, data []byte, version string) error {
+	header := chunkHeader{version: version, sessionID: s.sessionID}
+	chunks, err := encodeChunks(data, header, descriptionChunkSize, s.instanceCount-firstInstanceID)
+	if err != nil {
+		return err
+	}
+	for i := len(chunks) - 1; i >= 0; i-- {
+		err := s.store.writeResource(firstInstanceID+i, resourceID, chunks[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *inventorySignaler) readChunks(resourceID, firstInstanceID int) ([]byte, chunkHeader, error) {
+	return decodeChunks(func(index int) (string, error) {
+		return s.store.readResource(firstInstanceID+index, resourceID)
+	}, s.instanceCount-firstInstanceID)
+}
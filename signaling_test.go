@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc"
+)
+
+// fakeResourceStore はメモリ上でリソースを読み書きするresourceStore
+// SORACOM APIと同様に変更の通知は行わない
+// executeResourceでonExecuteを呼び、デバイス側のプロセスの起動を模擬する
+type fakeResourceStore struct {
+	mu        sync.Mutex
+	values    map[[2]int]string
+	onExecute func()
+}
+
+func newFakeResourceStore() *fakeResourceStore {
+	return &fakeResourceStore{values: map[[2]int]string{}}
+}
+
+func (s *fakeResourceStore) readResource(instanceID, resourceID int) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values[[2]int{instanceID, resourceID}], nil
+}
+
+func (s *fakeResourceStore) writeResource(instanceID, resourceID int, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[[2]int{instanceID, resourceID}] = value
+	return nil
+}
+
+func (s *fakeResourceStore) executeResource(instanceID, resourceID int) error {
+	if s.onExecute == nil {
+		return errors.New("execute is not supported")
+	}
+	go s.onExecute()
+	return nil
+}
+
+var (
+	testOffer  = webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=offer\r\n"}
+	testAnswer = webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: "v=0\r\no=- 2 1 IN IP4 0.0.0.0\r\ns=answer\r\n"}
+)
+
+func TestSignalingOfferAnswer(t *testing.T) {
+	store := newFakeResourceStore()
+	device := newInventorySignaler(store)
+	answerCh := make(chan webrtc.SessionDescription, 1)
+	errCh := make(chan error, 1)
+	store.onExecute = func() {
+		err := device.acceptRequest()
+		if err == nil {
+			err = device.publishOffer(testOffer)
+		}
+		if err != nil {
+			errCh <- err
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		answer, err := device.awaitAnswer(ctx)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		answerCh <- answer
+		device.publishStatus(signalingStatusAnswered)
+	}
+
+	client := newInventorySignaler(store)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := client.startSignaling()
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, err := client.awaitOffer(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offer != testOffer {
+		t.Fatalf("offer = %+v, want %+v", offer, testOffer)
+	}
+	err = client.publishAnswer(testAnswer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case answer := <-answerCh:
+		if answer != testAnswer {
+			t.Fatalf("answer = %+v, want %+v", answer, testAnswer)
+		}
+	case err := <-errCh:
+		t.Fatal(err)
+	}
+	err = client.awaitStatus(ctx, signalingStatusAnswered, signalingStatusConnected)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignalingAwaitAnswerTimeout(t *testing.T) {
+	store := newFakeResourceStore()
+	device := newInventorySignaler(store)
+	err := device.publishOffer(testOffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = device.awaitAnswer(ctx)
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("err = %v, want timeout", err)
+	}
+}
+
+func TestSignalingAwaitStatusFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		device  func(device *inventorySignaler)
+		wantErr string
+	}{
+		{
+			name:    "failed",
+			device:  func(device *inventorySignaler) { device.publishFailure("no network") },
+			wantErr: "device failed: no network",
+		},
+		{
+			name:    "busy",
+			device:  func(device *inventorySignaler) { device.publishBusy() },
+			wantErr: "device is busy",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newFakeResourceStore()
+			device := newInventorySignaler(store)
+			store.onExecute = func() {
+				device.acceptRequest()
+				test.device(device)
+			}
+			client := newInventorySignaler(store)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err := client.startSignaling()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = client.awaitOffer(ctx)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("err = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignalingIgnoresStaleStatus(t *testing.T) {
+	store := newFakeResourceStore()
+	// 以前のセッションで失敗し、別のクライアントにbusyを通知した後の状態
+	previous := newInventorySignaler(store)
+	previous.requestID = "previous"
+	previous.publishFailure("previous failure")
+	previous.publishBusy()
+	store.onExecute = func() {}
+
+	client := newInventorySignaler(store)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	err := client.startSignaling()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.awaitOffer(ctx)
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("err = %v, want timeout", err)
+	}
+}
+
+func TestSignalingIgnoresStaleSessionAnswer(t *testing.T) {
+	store := newFakeResourceStore()
+	device := newInventorySignaler(store)
+	err := device.publishOffer(testOffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		stale := newInventorySignaler(store)
+		stale.sessionID = "stale"
+		stale.publishAnswer(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: "v=0\r\ns=stale\r\n"})
+		time.Sleep(100 * time.Millisecond)
+		client := newInventorySignaler(store)
+		client.sessionID = device.sessionID
+		client.publishAnswer(testAnswer)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	answer, err := device.awaitAnswer(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer != testAnswer {
+		t.Fatalf("answer = %+v, want %+v", answer, testAnswer)
+	}
+}
+
+func TestSignalingAwaitAnswerReportsLastError(t *testing.T) {
+	tests := []struct {
+		name       string
+		publish    func(store *fakeResourceStore, sessionID string)
+		wantErr    string
+		wantReason string
+	}{
+		{
+			name: "stale session",
+			publish: func(store *fakeResourceStore, sessionID string) {
+				stale := newInventorySignaler(store)
+				stale.sessionID = "stale"
+				stale.publishAnswer(testAnswer)
+			},
+			wantErr:    "another session",
+			wantReason: "request-1:stale answer stale",
+		},
+		{
+			name: "corrupted answer",
+			publish: func(store *fakeResourceStore, sessionID string) {
+				client := newInventorySignaler(store)
+				client.sessionID = sessionID
+				client.publishAnswer(testAnswer)
+				value, _ := store.readResource(0, answerResourceID)
+				store.writeResource(0, answerResourceID, value[:len(value)-1]+"!")
+			},
+			wantErr: "checksum mismatch",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newFakeResourceStore()
+			device := newInventorySignaler(store)
+			device.requestID = "request-1"
+			err := device.publishOffer(testOffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.publish(store, device.sessionID)
+			ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cancel()
+			_, err = device.awaitAnswer(ctx)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("err = %v, want %q", err, test.wantErr)
+			}
+			if test.wantReason != "" {
+				reason, _ := store.readResource(reasonInstanceID, reasonResourceID)
+				if reason != test.wantReason {
+					t.Fatalf("reason = %q, want %q", reason, test.wantReason)
+				}
+			}
+		})
+	}
+}
+
+func testCandidate(candidate string) webrtc.ICECandidateInit {
+	mid := "0"
+	index := uint16(0)
+	return webrtc.ICECandidateInit{Candidate: candidate, SDPMid: &mid, SDPMLineIndex: &index}
+}
+
+func TestSignalingCandidates(t *testing.T) {
+	store := newFakeResourceStore()
+	device := newInventorySignaler(store)
+	err := device.publishOffer(testOffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newInventorySignaler(store)
+	client.sessionID = device.sessionID
+
+	candidates := []webrtc.ICECandidateInit{
+		testCandidate("candidate:1 1 udp 2130706431 192.168.1.10 50000 typ host"),
+		testCandidate("candidate:2 1 udp 2130706431 fe80::1 50001 typ host"),
+		testCandidate("candidate:3 1 udp 1694498815 203.0.113.1 50002 typ srflx raddr 0.0.0.0 rport 50002"),
+	}
+	go func() {
+		// 以前のセッションの候補は無視される
+		stale := newInventorySignaler(store)
+		stale.sessionID = "stale"
+		stale.isDevice = true
+		stale.publishCandidates([]webrtc.ICECandidateInit{testCandidate("candidate:9 1 udp 1 10.0.0.1 9 typ host")}, true)
+		time.Sleep(100 * time.Millisecond)
+		device.publishCandidates(candidates[:1], false)
+		time.Sleep(100 * time.Millisecond)
+		device.publishCandidates(candidates, true)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	received := []webrtc.ICECandidateInit{}
+	err = client.awaitCandidates(ctx, func(candidate webrtc.ICECandidateInit) {
+		received = append(received, candidate)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != len(candidates) {
+		t.Fatalf("received %d candidates, want %d", len(received), len(candidates))
+	}
+	for i, candidate := range received {
+		if candidate.Candidate != candidates[i].Candidate || *candidate.SDPMid != "0" || *candidate.SDPMLineIndex != 0 {
+			t.Errorf("candidate %d = %+v, want %+v", i, candidate, candidates[i])
+		}
+	}
+}
+
+func TestSignalingCandidatesTooMany(t *testing.T) {
+	store := newFakeResourceStore()
+	device := newInventorySignaler(store)
+	device.isDevice = true
+	candidates := []webrtc.ICECandidateInit{}
+	for i := 0; i < 200; i++ {
+		candidates = append(candidates, testCandidate("candidate:1 1 udp 2130706431 192.168.1.10 50000 typ host"))
+	}
+	err := device.publishCandidates(candidates, true)
+	if err == nil {
+		t.Fatal("want error for candidates exceeding instances")
+	}
+}
+
+func TestNextPollInterval(t *testing.T) {
+	want := []time.Duration{
+		750 * time.Millisecond, 1125 * time.Millisecond, 1687500 * time.Microsecond,
+		2531250 * time.Microsecond, 3796875 * time.Microsecond, pollMaxInterval, pollMaxInterval}
+	interval := pollInitialInterval
+	for i, w := range want {
+		interval = nextPollInterval(interval)
+		if interval != w {
+			t.Fatalf("interval %d = %v, want %v", i, interval, w)
+		}
+	}
+}
+
+// failingWatchStore は変更の監視に失敗するresourceStore
+type failingWatchStore struct {
+	*fakeResourceStore
+}
+
+func (s *failingWatchStore) watchResource(instanceID, resourceID int) (<-chan struct{}, func(), error) {
+	return nil, nil, errors.New("watch is not available")
+}
+
+// 変更を監視できない場合はポーリングで確認する
+func TestWaitResourcePolling(t *testing.T) {
+	tests := []struct {
+		name  string
+		store resourceStore
+	}{
+		{name: "no watcher", store: newFakeResourceStore()},
+		{name: "watch error", store: &failingWatchStore{newFakeResourceStore()}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sig := newInventorySignaler(test.store)
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				test.store.writeResource(0, statusResourceID, "1")
+			}()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			start := time.Now()
+			value, err := sig.waitResource(ctx, 0, statusResourceID, func(value string) bool { return value == "1" })
+			if err != nil || value != "1" {
+				t.Fatalf("value = %q, %v, want 1", value, err)
+			}
+			// 書き込みの後、最初のポーリングで確認する
+			if elapsed := time.Since(start); elapsed < pollInitialInterval {
+				t.Fatalf("returned after %v, want after the first poll (%v)", elapsed, pollInitialInterval)
+			}
+		})
+	}
+}
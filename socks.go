@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pion/webrtc"
+)
+
+// SOCKS5(RFC 1928)のうち、認証なしのCONNECTのみを扱う
+const (
+	socksVersion                  byte = 0x05
+	socksMethodNoAuth             byte = 0x00
+	socksMethodNoAcceptable       byte = 0xff
+	socksCommandConnect           byte = 0x01
+	socksAddressIPv4              byte = 0x01
+	socksAddressDomain            byte = 0x03
+	socksAddressIPv6              byte = 0x04
+	socksReplySucceeded           byte = 0x00
+	socksReplyGeneralFailure      byte = 0x01
+	socksReplyNetworkUnreachable  byte = 0x03
+	socksReplyHostUnreachable     byte = 0x04
+	socksReplyConnectionRefused   byte = 0x05
+	socksReplyNotSupported        byte = 0x07
+	socksReplyAddressNotSupported byte = 0x08
+)
+
+// dynamicForwardFlags は[bind:]portの複数指定を受け付ける
+// bindを省略した場合はlocalhostで待ち受ける
+type dynamicForwardFlags []string
+
+func (f *dynamicForwardFlags) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *dynamicForwardFlags) Set(value string) error {
+	listenAddress, err := parseListenAddress(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, listenAddress)
+	return nil
+}
+
+// startDynamicForward はSOCKS5サーバーとして待ち受け、CONNECTの接続先にデバイス側から接続する
+func startDynamicForward(peerConnection *webrtc.PeerConnection, listenAddress string) error {
+	listener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return fmt.Errorf("fail to listen %s", listenAddress)
+	}
+	go func() {
+		defer listener.Close()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				err := acceptSocksConn(peerConnection, conn)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					conn.Close()
+				}
+			}()
+		}
+	}()
+	return nil
+}
+
+// acceptSocksConn はSOCKS5のネゴシエーションを行い、接続先へのデータチャネルと中継する
+func acceptSocksConn(peerConnection *webrtc.PeerConnection, conn net.Conn) error {
+	targetAddress, err := readSocksRequest(conn)
+	if err != nil {
+		return err
+	}
+	dataChannel, err := peerConnection.CreateDataChannel(forwardChannelLabelPrefix+targetAddress, nil)
+	if err != nil {
+		conn.Write(socksReply(socksReplyGeneralFailure))
+		return errors.New("fail to create forward channel")
+	}
+	// デバイス側で接続先に接続した結果を待ってから応答する
+	dialResultCh := make(chan error, 1)
+	bridgeDataChannelWithDialResult(dataChannel, func() (io.ReadWriteCloser, error) {
+		err := <-dialResultCh
+		_, writeErr := conn.Write(socksReply(socksReplyCode(err)))
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("fail to connect %s: %s", targetAddress, err)
+		}
+		if writeErr != nil {
+			conn.Close()
+			return nil, writeErr
+		}
+		return conn, nil
+	}, dialResultCh)
+	return nil
+}
+
+// socksReply はバインドアドレスを省略した応答を返す
+func socksReply(code byte) []byte {
+	return []byte{socksVersion, code, 0x00, socksAddressIPv4, 0, 0, 0, 0, 0, 0}
+}
+
+// socksReplyCode はデバイス側の接続の結果を応答のコードに変換する
+func socksReplyCode(err error) byte {
+	if err == nil {
+		return socksReplySucceeded
+	}
+	dialErr, ok := err.(*bridgeDialError)
+	if !ok {
+		return socksReplyGeneralFailure
+	}
+	switch dialErr.kind {
+	case dialErrorRefused:
+		return socksReplyConnectionRefused
+	case dialErrorHostUnreachable:
+		return socksReplyHostUnreachable
+	case dialErrorNetworkUnreachable:
+		return socksReplyNetworkUnreachable
+	default:
+		return socksReplyGeneralFailure
+	}
+}
+
+// readSocksRequest は認証方式の選択とCONNECT要求を読み取り、接続先のhost:portを返す
+func readSocksRequest(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(conn, header)
+	if err != nil || header[0] != socksVersion {
+		return "", errors.New("invalid socks greeting")
+	}
+	methods := make([]byte, header[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return "", errors.New("invalid socks greeting")
+	}
+	if !strings.ContainsRune(string(methods), rune(socksMethodNoAuth)) {
+		conn.Write([]byte{socksVersion, socksMethodNoAcceptable})
+		return "", errors.New("socks client requires authentication")
+	}
+	_, err = conn.Write([]byte{socksVersion, socksMethodNoAuth})
+	if err != nil {
+		return "", err
+	}
+
+	request := make([]byte, 4)
+	_, err = io.ReadFull(conn, request)
+	if err != nil || request[0] != socksVersion {
+		return "", errors.New("invalid socks request")
+	}
+	var host string
+	switch request[3] {
+	case socksAddressIPv4, socksAddressIPv6:
+		addressLen := net.IPv4len
+		if request[3] == socksAddressIPv6 {
+			addressLen = net.IPv6len
+		}
+		address := make([]byte, addressLen)
+		_, err = io.ReadFull(conn, address)
+		host = net.IP(address).String()
+	case socksAddressDomain:
+		domainLen := make([]byte, 1)
+		_, err = io.ReadFull(conn, domainLen)
+		if err == nil {
+			domain := make([]byte, domainLen[0])
+			_, err = io.ReadFull(conn, domain)
+			host = string(domain)
+		}
+	default:
+		conn.Write(socksReply(socksReplyAddressNotSupported))
+		return "", errors.New("unsupported socks address type")
+	}
+	if err != nil {
+		return "", errors.New("invalid socks request")
+	}
+	port := make([]byte, 2)
+	_, err = io.ReadFull(conn, port)
+	if err != nil {
+		return "", errors.New("invalid socks request")
+	}
+	if request[1] != socksCommandConnect {
+		conn.Write(socksReply(socksReplyNotSupported))
+		return "", errors.New("unsupported socks command")
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+// socksTestConn はinputを読み出し、書き込まれた応答をoutputに保持するnet.Conn
+type socksTestConn struct {
+	net.Conn
+	input  *bytes.Reader
+	output bytes.Buffer
+}
+
+func (c *socksTestConn) Read(p []byte) (int, error) {
+	return c.input.Read(p)
+}
+
+func (c *socksTestConn) Write(p []byte) (int, error) {
+	return c.output.Write(p)
+}
+
+func TestReadSocksRequest(t *testing.T) {
+	greeting := []byte{socksVersion, 1, socksMethodNoAuth}
+	tests := []struct {
+		name      string
+		input     []byte
+		want      string
+		wantErr   bool
+		wantReply []byte
+	}{
+		{
+			name:      "ipv4",
+			input:     append(greeting, socksVersion, socksCommandConnect, 0x00, socksAddressIPv4, 192, 168, 1, 10, 0x01, 0xf6),
+			want:      "192.168.1.10:502",
+			wantReply: []byte{socksVersion, socksMethodNoAuth},
+		},
+		{
+			name:      "ipv6",
+			input:     append(greeting, socksVersion, socksCommandConnect, 0x00, socksAddressIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x00, 0x16),
+			want:      "[::1]:22",
+			wantReply: []byte{socksVersion, socksMethodNoAuth},
+		},
+		{
+			name:      "domain",
+			input:     append(greeting, socksVersion, socksCommandConnect, 0x00, socksAddressDomain, 6, 'c', 'a', 'm', 'e', 'r', 'a', 0x00, 0x50),
+			want:      "camera:80",
+			wantReply: []byte{socksVersion, socksMethodNoAuth},
+		},
+		{
+			name:      "multiple methods",
+			input:     []byte{socksVersion, 2, 0x02, socksMethodNoAuth, socksVersion, socksCommandConnect, 0x00, socksAddressIPv4, 10, 0, 0, 1, 0x00, 0x50},
+			want:      "10.0.0.1:80",
+			wantReply: []byte{socksVersion, socksMethodNoAuth},
+		},
+		{
+			name:      "authentication required",
+			input:     []byte{socksVersion, 1, 0x02},
+			wantErr:   true,
+			wantReply: []byte{socksVersion, socksMethodNoAcceptable},
+		},
+		{
+			name:      "bind command",
+			input:     append(greeting, socksVersion, 0x02, 0x00, socksAddressIPv4, 10, 0, 0, 1, 0x00, 0x50),
+			wantErr:   true,
+			wantReply: append([]byte{socksVersion, socksMethodNoAuth}, socksReply(socksReplyNotSupported)...),
+		},
+		{
+			name:    "socks4",
+			input:   []byte{0x04, 0x01, 0x00, 0x50, 10, 0, 0, 1, 0x00},
+			wantErr: true,
+		},
+		{
+			name:      "unknown address type",
+			input:     append(greeting, socksVersion, socksCommandConnect, 0x00, 0x09, 0x00, 0x50),
+			wantErr:   true,
+			wantReply: append([]byte{socksVersion, socksMethodNoAuth}, socksReply(socksReplyAddressNotSupported)...),
+		},
+		{
+			name:      "truncated request",
+			input:     append(greeting, socksVersion, socksCommandConnect, 0x00, socksAddressIPv4, 10, 0),
+			wantErr:   true,
+			wantReply: []byte{socksVersion, socksMethodNoAuth},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := &socksTestConn{input: bytes.NewReader(test.input)}
+			got, err := readSocksRequest(conn)
+			reply := conn.output.Bytes()
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got %q", got)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("address = %q, want %q", got, test.want)
+			}
+			if !bytes.Equal(reply, test.wantReply) {
+				t.Errorf("reply = %v, want %v", reply, test.wantReply)
+			}
+		})
+	}
+}
+
+func TestSocksReplyCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want byte
+	}{
+		{err: nil, want: socksReplySucceeded},
+		{err: &bridgeDialError{kind: dialErrorRefused}, want: socksReplyConnectionRefused},
+		{err: &bridgeDialError{kind: dialErrorHostUnreachable}, want: socksReplyHostUnreachable},
+		{err: &bridgeDialError{kind: dialErrorNetworkUnreachable}, want: socksReplyNetworkUnreachable},
+		{err: &bridgeDialError{kind: dialErrorFailed}, want: socksReplyGeneralFailure},
+		{err: &bridgeDialError{kind: "unknown"}, want: socksReplyGeneralFailure},
+		{err: errors.New("forward channel is closed"), want: socksReplyGeneralFailure},
+	}
+	for _, test := range tests {
+		if got := socksReplyCode(test.err); got != test.want {
+			t.Errorf("%v: reply code = %#x, want %#x", test.err, got, test.want)
+		}
+	}
+}
+
+func TestDialErrorKind(t *testing.T) {
+	// 閉じたポートへの接続は拒否される
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	_, err = net.Dial("tcp", address)
+	if err == nil {
+		t.Skip("closed port accepted connection")
+	}
+	if got := dialErrorKind(err); got != dialErrorRefused {
+		t.Errorf("kind = %q, want %q (%v)", got, dialErrorRefused, err)
+	}
+	if got := dialErrorKind(&net.DNSError{Err: "no such host", Name: "camera.invalid", IsNotFound: true}); got != dialErrorHostUnreachable {
+		t.Errorf("kind = %q, want %q", got, dialErrorHostUnreachable)
+	}
+	if got := dialErrorKind(errors.New("unknown")); got != dialErrorFailed {
+		t.Errorf("kind = %q, want %q", got, dialErrorFailed)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// /v1/devicesの1ページあたりの取得件数
+const devicesPageSize = 100
+
+// カバレッジごとのSORACOM APIのURL
+var coverageAPIEndpoints = map[string]string{
+	"jp": "https://api.soracom.io",
+	"g":  "https://g.api.soracom.io",
+}
+
+// soracomCredential は/v1/authに送信する認証情報
+// メールアドレス、AuthKey(SAMユーザーを含む)、SAMユーザー名のいずれかを指定する
+type soracomCredential struct {
+	Email      string `json:"email,omitempty"`
+	Password   string `json:"password,omitempty"`
+	AuthKeyId  string `json:"authKeyId,omitempty"`
+	AuthKey    string `json:"authKey,omitempty"`
+	OperatorId string `json:"operatorId,omitempty"`
+	UserName   string `json:"userName,omitempty"`
+
+	TokenTimeoutSeconds int `json:"tokenTimeoutSeconds,omitempty"`
+}
+
+// identity はトークンキャッシュの識別に使う秘密情報を含まない文字列を返す
+func (c *soracomCredential) identity() string {
+	switch {
+	case c.AuthKeyId != "":
+		return "authKeyId:" + c.AuthKeyId
+	case c.UserName != "":
+		return "user:" + c.OperatorId + "/" + c.UserName
+	case c.Email != "":
+		return "email:" + c.Email
+	}
+	return ""
+}
+
+type soracomToken struct {
+	ApiKey     string `json:"apiKey"`
+	OperatorId string `json:"operatorId"`
+	Token      string `json:"token"`
+}
+
+type inventoryDevice struct {
+	DeviceId string            `json:"deviceId"`
+	Endpoint string            `json:"endpoint"`
+	Online   bool              `json:"online"`
+	Tags     map[string]string `json:"tags"`
+}
+
+type inventoryResource struct {
+	Id    int             `json:"id"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+type valueJson struct {
+	Value string `json:"value"`
+}
+
+// soracomClient はSORACOM APIへのアクセスを行う
+// APIのURLと認証後のトークンを保持し、トークンが無効になった場合はcredentialFuncで取得した認証情報で再認証する
+// trickle ICEなど複数のgoroutineから同時に使用するため、トークンはtokenMuで保護し、再認証はauthMuで1つずつ行う
+type soracomClient struct {
+	apiEndpoint    string
+	tokenMu        sync.Mutex
+	token          *soracomToken
+	authMu         sync.Mutex
+	tokenCache     *tokenCache
+	credentialFunc func() (*soracomCredential, error)
+}
+
+func newSoracomClient(apiEndpoint string) *soracomClient {
+	return &soracomClient{apiEndpoint: strings.TrimRight(apiEndpoint, "/")}
+}
+
+// resolveAPIEndpoint はカバレッジ指定とURL指定からSORACOM APIのURLを決定する
+// URLが指定されている場合はカバレッジ指定より優先する
+func resolveAPIEndpoint(coverage, apiEndpoint string) (string, error) {
+	if apiEndpoint != "" {
+		return apiEndpoint, nil
+	}
+	if coverage == "" {
+		coverage = "jp"
+	}
+	endpoint, ok := coverageAPIEndpoints[coverage]
+	if !ok {
+		return "", errors.New("invalid coverage (jp/g)")
+	}
+	return endpoint, nil
+}
+
+func (c *soracomClient) request(method, path string, data interface{}) ([]byte, error) {
+	buf, _, err := c.requestWithHeader(method, path, data)
+	return buf, err
+}
+
+func (c *soracomClient) requestWithHeader(method, path string, data interface{}) ([]byte, http.Header, error) {
+	token := c.currentToken()
+	buf, header, statusCode, err := c.doRequest(method, path, data, token)
+	if err == nil && statusCode == http.StatusUnauthorized && token != nil && c.credentialFunc != nil {
+		// トークンが期限切れ等で無効になっている場合は再認証して再送する
+		err = c.reauth(token)
+		if err != nil {
+			return nil, nil, err
+		}
+		buf, header, statusCode, err = c.doRequest(method, path, data, c.currentToken())
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if statusCode < 300 {
+		return buf, header, nil
+	} else {
+		return nil, nil, &apiError{statusCode: statusCode, body: string(buf)}
+	}
+}
+
+// apiError はSORACOM APIが成功以外のステータスコードを返したことを表す
+type apiError struct {
+	statusCode int
+	body       string
+}
+
+func (e *apiError) Error() string {
+	return "fail to request API\n" + e.body
+}
+
+func (c *soracomClient) currentToken() *soracomToken {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	return c.token
+}
+
+func (c *soracomClient) setToken(token *soracomToken) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	c.token = token
+}
+
+// doRequest はtokenを指定した場合はそのトークンでリクエストを送信する
+func (c *soracomClient) doRequest(method, path string, data interface{}, token *soracomToken) ([]byte, http.Header, int, error) {
+	var req *http.Request
+	var err error
+	requestURL := c.apiEndpoint + path
+	if data != nil {
+		payloadBytes, err := json.Marshal(data)
+		if err != nil {
+			return nil, nil, 0, errors.New("fail to serialize data")
+		}
+		body := bytes.NewReader(payloadBytes)
+		req, err = http.NewRequest(method, requestURL, body)
+		if err != nil {
+			return nil, nil, 0, errors.New("fail to create http request")
+		}
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req, err = http.NewRequest(method, requestURL, nil)
+		if err != nil {
+			return nil, nil, 0, errors.New("fail to create http request")
+		}
+	}
+	req.Header.Set("Accept", "application/json")
+	if token != nil {
+		req.Header.Set("X-Soracom-Api-Key", token.ApiKey)
+		req.Header.Set("X-Soracom-Token", token.Token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, 0, errors.New("fail to access via http")
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, 0, errors.New("fail to read http body")
+	}
+	return buf, resp.Header, resp.StatusCode, nil
+}
+
+// auth はトークンを付けずに/v1/authに認証情報を送信し、取得したトークンに置き換える
+func (c *soracomClient) auth(credential *soracomCredential) error {
+	credential.TokenTimeoutSeconds = tokenTimeoutSeconds
+	issuedAt := time.Now()
+	buf, _, statusCode, err := c.doRequest("POST", "/v1/auth", credential, nil)
+	if err != nil {
+		return err
+	}
+	if statusCode >= 300 {
+		return errors.New("fail to request API\n" + string(buf))
+	}
+	var token = &soracomToken{}
+	err = json.Unmarshal(buf, token)
+	if err != nil {
+		return errors.New("fail to parse token")
+	}
+	c.setToken(token)
+	if c.tokenCache != nil {
+		err = c.tokenCache.save(token, issuedAt.Add(time.Duration(tokenTimeoutSeconds)*time.Second))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	return nil
+}
+
+// loadCachedToken はキャッシュに有効なトークンがあれば使用し、trueを返す
+func (c *soracomClient) loadCachedToken() bool {
+	if c.tokenCache == nil {
+		return false
+	}
+	token := c.tokenCache.load()
+	if token == nil {
+		return false
+	}
+	c.setToken(token)
+	return true
+}
+
+// reauth は無効になったstaleのトークンを再認証して置き換える
+// 複数のgoroutineが同時に無効を検出した場合も、認証情報の取得(パスワードの入力など)と認証は1回だけ行う
+func (c *soracomClient) reauth(stale *soracomToken) error {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	if c.currentToken() != stale {
+		// 待っている間に他のgoroutineが再認証した
+		return nil
+	}
+	if c.tokenCache != nil {
+		c.tokenCache.clear()
+	}
+	credential, err := c.credentialFunc()
+	if err != nil {
+		return err
+	}
+	return c.auth(credential)
+}
+
+// listDevices はx-soracom-next-keyを使ってページングしながら全デバイスを取得する
+func (c *soracomClient) listDevices() ([]inventoryDevice, error) {
+	devices := []inventoryDevice{}
+	lastEvaluatedKey := ""
+	for {
+		query := url.Values{}
+		query.Set("limit", strconv.Itoa(devicesPageSize))
+		if lastEvaluatedKey != "" {
+			query.Set("last_evaluated_key", lastEvaluatedKey)
+		}
+		buf, header, err := c.requestWithHeader("GET", "/v1/devices?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		var page []inventoryDevice
+		err = json.Unmarshal(buf, &page)
+		if err != nil {
+			return nil, errors.New("fail to parse devices")
+		}
+		devices = append(devices, page...)
+		lastEvaluatedKey = header.Get("X-Soracom-Next-Key")
+		if lastEvaluatedKey == "" || len(page) == 0 {
+			return devices, nil
+		}
+	}
+}
+
+func (c *soracomClient) getDevice(deviceID string) (*inventoryDevice, error) {
+	buf, err := c.request("GET", "/v1/devices/"+url.PathEscape(deviceID), nil)
+	if err != nil {
+		return nil, err
+	}
+	var device = &inventoryDevice{}
+	err = json.Unmarshal(buf, device)
+	if err != nil {
+		return nil, errors.New("fail to parse device")
+	}
+	return device, nil
+}
+
+func resourcePathOf(deviceID string, objectID, instanceID, resourceID int) string {
+	return "/v1/devices/" + deviceID + "/" + strconv.Itoa(objectID) + "/" + strconv.Itoa(instanceID) + "/" + strconv.Itoa(resourceID)
+}
+
+func (c *soracomClient) readResource(deviceID string, objectID, instanceID, resourceID int) (string, error) {
+	buf, err := c.request("GET", resourcePathOf(deviceID, objectID, instanceID, resourceID)+"?model=false", nil)
+	if err != nil {
+		return "", err
+	}
+	var resource = &inventoryResource{}
+	err = json.Unmarshal(buf, resource)
+	if err != nil {
+		return "", errors.New("fail to parse resource")
+	}
+	// 文字列型以外(整数型など)は値をそのまま文字列として扱う
+	var value string
+	err = json.Unmarshal(resource.Value, &value)
+	if err != nil {
+		value = string(resource.Value)
+	}
+	return value, nil
+}
+
+func (c *soracomClient) writeResource(deviceID string, objectID, instanceID, resourceID int, value string) error {
+	_, err := c.request("PUT", resourcePathOf(deviceID, objectID, instanceID, resourceID), &valueJson{Value: value})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *soracomClient) executeResource(deviceID string, objectID, instanceID, resourceID int) error {
+	_, err := c.request("POST", resourcePathOf(deviceID, objectID, instanceID, resourceID)+"/execute", nil)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestProfile はsoracom-cliのプロファイルを一時ディレクトリに作成し、SORACOM_PROFILE_DIRに設定する
+func writeTestProfile(t *testing.T, name, profile string) {
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, name+".json"), []byte(profile), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SORACOM_PROFILE_DIR", dir)
+}
+
+func TestResolveAPIEndpoint(t *testing.T) {
+	tests := []struct {
+		coverage    string
+		apiEndpoint string
+		want        string
+		wantErr     bool
+	}{
+		{want: "https://api.soracom.io"},
+		{coverage: "jp", want: "https://api.soracom.io"},
+		{coverage: "g", want: "https://g.api.soracom.io"},
+		{coverage: "us", wantErr: true},
+		// URLの指定はカバレッジの指定より優先する
+		{apiEndpoint: "http://localhost:8080", want: "http://localhost:8080"},
+		{coverage: "g", apiEndpoint: "http://localhost:8080", want: "http://localhost:8080"},
+		{coverage: "us", apiEndpoint: "http://localhost:8080", want: "http://localhost:8080"},
+	}
+	for _, test := range tests {
+		got, err := resolveAPIEndpoint(test.coverage, test.apiEndpoint)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q, %q: want error", test.coverage, test.apiEndpoint)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%q, %q: got %q, %v, want %q", test.coverage, test.apiEndpoint, got, err, test.want)
+		}
+	}
+}
+
+// プロファイルのcoverageTypeとendpointは、--coverageと--api-endpointを省略した場合のみ使用する
+func TestSetupSoracomClientEndpoint(t *testing.T) {
+	tests := []struct {
+		name        string
+		profile     string
+		coverage    string
+		apiEndpoint string
+		want        string
+	}{
+		{name: "profile coverage", profile: `{"coverageType": "g"}`, want: "https://g.api.soracom.io"},
+		{name: "flag coverage", profile: `{"coverageType": "g"}`, coverage: "jp", want: "https://api.soracom.io"},
+		{name: "profile endpoint", profile: `{"coverageType": "g", "endpoint": "http://localhost:8080"}`, want: "http://localhost:8080"},
+		{name: "flag endpoint", profile: `{"endpoint": "http://localhost:8080"}`, apiEndpoint: "http://localhost:9090/", want: "http://localhost:9090"},
+		{name: "profile endpoint with flag coverage", profile: `{"endpoint": "http://localhost:8080"}`, coverage: "g", want: "http://localhost:8080"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writeTestProfile(t, "test", test.profile)
+			client, err := setupSoracomClient("test", test.coverage, test.apiEndpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if client.apiEndpoint != test.want {
+				t.Fatalf("apiEndpoint = %q, want %q", client.apiEndpoint, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	tokenTimeoutSeconds int           = 86400
+	tokenExpiryMargin   time.Duration = 5 * time.Minute
+)
+
+// cachedToken はディスクに保存するトークンと有効期限
+type cachedToken struct {
+	Token     soracomToken `json:"token"`
+	ExpiresAt time.Time    `json:"expiresAt"`
+}
+
+// tokenCache はAPIのURLと認証情報の識別子ごとにトークンをキャッシュする
+// キャッシュファイルは所有者のみ読み書き可能なパーミッションで保存する
+type tokenCache struct {
+	filePath string
+}
+
+func newTokenCache(apiEndpoint, identity string) (*tokenCache, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, errors.New("fail to get cache directory")
+	}
+	hash := sha256.Sum256([]byte(apiEndpoint + "\n" + identity))
+	fileName := hex.EncodeToString(hash[:8]) + ".json"
+	return &tokenCache{filePath: filepath.Join(cacheDir, "inventory-terminal", "tokens", fileName)}, nil
+}
+
+// load は有効期限内のトークンを返す。存在しないか期限切れの場合はnilを返す
+func (c *tokenCache) load() *soracomToken {
+	buf, err := ioutil.ReadFile(c.filePath)
+	if err != nil {
+		return nil
+	}
+	var cached cachedToken
+	err = json.Unmarshal(buf, &cached)
+	if err != nil {
+		return nil
+	}
+	if time.Now().Add(tokenExpiryMargin).After(cached.ExpiresAt) {
+		return nil
+	}
+	return &cached.Token
+}
+
+// save は一時ファイルに書き込んでから置き換える
+// 既存のファイルのパーミッションに関わらず、所有者のみ読み書き可能なファイルになる
+func (c *tokenCache) save(token *soracomToken, expiresAt time.Time) error {
+	cacheDir := filepath.Dir(c.filePath)
+	err := os.MkdirAll(cacheDir, 0700)
+	if err == nil {
+		err = os.Chmod(cacheDir, 0700)
+	}
+	if err != nil {
+		return errors.New("fail to create token cache directory")
+	}
+	buf, err := json.Marshal(&cachedToken{Token: *token, ExpiresAt: expiresAt})
+	if err != nil {
+		return errors.New("fail to serialize token")
+	}
+	file, err := ioutil.TempFile(cacheDir, ".token-")
+	if err != nil {
+		return errors.New("fail to save token")
+	}
+	_, err = file.Write(buf)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), c.filePath)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return errors.New("fail to save token")
+	}
+	return nil
+}
+
+func (c *tokenCache) clear() {
+	os.Remove(c.filePath)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestTokenCache(t *testing.T) *tokenCache {
+	return &tokenCache{filePath: filepath.Join(t.TempDir(), "tokens", "test.json")}
+}
+
+func TestTokenCacheSaveLoad(t *testing.T) {
+	cache := newTestTokenCache(t)
+	if token := cache.load(); token != nil {
+		t.Fatalf("load = %+v, want nil before save", token)
+	}
+	token := &soracomToken{ApiKey: "api", OperatorId: "OP", Token: "token"}
+	err := cache.save(token, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(cache.filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("file mode = %o, want 600", mode)
+	}
+	info, err = os.Stat(filepath.Dir(cache.filePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0700 {
+		t.Errorf("directory mode = %o, want 700", mode)
+	}
+	loaded := cache.load()
+	if loaded == nil || *loaded != *token {
+		t.Fatalf("load = %+v, want %+v", loaded, token)
+	}
+
+	// 既存のファイルのパーミッションに関わらず置き換える
+	err = os.Chmod(cache.filePath, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cache.save(token, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = os.Stat(cache.filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("file mode after overwrite = %o, want 600", mode)
+	}
+
+	cache.clear()
+	if token := cache.load(); token != nil {
+		t.Fatalf("load = %+v, want nil after clear", token)
+	}
+}
+
+func TestTokenCacheExpired(t *testing.T) {
+	cache := newTestTokenCache(t)
+	token := &soracomToken{ApiKey: "api", OperatorId: "OP", Token: "token"}
+	// 有効期限まで余裕のないトークンは使用しない
+	err := cache.save(token, time.Now().Add(tokenExpiryMargin/2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded := cache.load(); loaded != nil {
+		t.Fatalf("load = %+v, want nil for expiring token", loaded)
+	}
+}
+
+// 2回目の実行ではキャッシュしたトークンを使用し、認証情報を取得しない
+func TestLoginSoracomReusesCachedToken(t *testing.T) {
+	_, httpServer, _ := newTestMockAPIServer(t)
+	cache := newTestTokenCache(t)
+	credentialCount := 0
+	newClient := func() *soracomClient {
+		client := newSoracomClient(httpServer.URL)
+		client.tokenCache = cache
+		client.credentialFunc = func() (*soracomCredential, error) {
+			credentialCount++
+			return &soracomCredential{Email: "test@example.com", Password: "password"}, nil
+		}
+		return client
+	}
+
+	for i := 0; i < 2; i++ {
+		client := newClient()
+		err := loginSoracom(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.getDevice(mockDeviceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if credentialCount != 1 {
+		t.Fatalf("credentialFunc called %d times, want 1", credentialCount)
+	}
+}
+
+// 同時に401を受け取った場合も再認証は1回だけ行い、それぞれ再送する
+func TestSoracomClientReauth(t *testing.T) {
+	_, httpServer, _ := newTestMockAPIServer(t)
+	client := newSoracomClient(httpServer.URL)
+	client.tokenCache = newTestTokenCache(t)
+	client.token = &soracomToken{ApiKey: mockApiKey, OperatorId: mockOperatorId, Token: "expired"}
+	var mu sync.Mutex
+	credentialCount := 0
+	client.credentialFunc = func() (*soracomCredential, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		credentialCount++
+		return &soracomCredential{Email: "test@example.com", Password: "password"}, nil
+	}
+
+	errCh := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func() {
+			_, err := client.getDevice(mockDeviceID)
+			errCh <- err
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		err := <-errCh
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if credentialCount != 1 {
+		t.Fatalf("credentialFunc called %d times, want 1", credentialCount)
+	}
+	if token := client.currentToken(); token.Token != mockToken {
+		t.Fatalf("token = %q, want %q", token.Token, mockToken)
+	}
+	if cached := client.tokenCache.load(); cached == nil || cached.Token != mockToken {
+		t.Fatalf("cached token = %+v, want %q", cached, mockToken)
+	}
+}
+
+// 再認証に失敗した場合はそのエラーを返す
+func TestSoracomClientReauthFailure(t *testing.T) {
+	_, httpServer, _ := newTestMockAPIServer(t)
+	client := newSoracomClient(httpServer.URL)
+	client.token = &soracomToken{ApiKey: mockApiKey, OperatorId: mockOperatorId, Token: "expired"}
+	client.credentialFunc = func() (*soracomCredential, error) {
+		return nil, errors.New("no credential")
+	}
+	_, err := client.getDevice(mockDeviceID)
+	if err == nil || err.Error() != "no credential" {
+		t.Fatalf("err = %v, want no credential", err)
+	}
+}
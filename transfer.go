@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc"
+)
+
+// ファイル転送のデータチャネルのラベル
+// 転送1回につきPC側でデータチャネルを1つ作成する
+const transferChannelLabel = "transfer"
+
+// ファイルの内容を分割して送信する大きさ
+// 送信待ちのデータがbridgeBufferedAmountHighを超えている間はポート転送と同様に送信を待つ
+const transferChunkSize = 16384
+
+// ファイル転送のメッセージの種類
+// put/getはPC側から、fileはgetに対してデバイス側から送信する
+// put/fileの後にファイルの内容をバイナリで分割して送信し、最後にendでSHA-256を送信する
+// 受信側は検証の結果をresultで返す
+const (
+	transferTypePut    = "put"
+	transferTypeGet    = "get"
+	transferTypeFile   = "file"
+	transferTypeEnd    = "end"
+	transferTypeResult = "result"
+)
+
+// transferMessage はファイル転送の制御メッセージ
+// Nameは送信元のファイル名で、保存先がディレクトリの場合にその中のファイル名として使う
+// Messageが空でないresultは失敗を表す
+type transferMessage struct {
+	Type    string `json:"type"`
+	Path    string `json:"path,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Mode    uint32 `json:"mode,omitempty"`
+	ModTime int64  `json:"modTime,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func sendTransferMessage(dataChannel *webrtc.DataChannel, message *transferMessage) error {
+	messageBytes, err := json.Marshal(message)
+	if err != nil {
+		return errors.New("fail to serialize transfer message")
+	}
+	return dataChannel.SendText(string(messageBytes))
+}
+
+func sendTransferResult(dataChannel *webrtc.DataChannel, err error) error {
+	message := &transferMessage{Type: transferTypeResult}
+	if err != nil {
+		message.Message = err.Error()
+	}
+	return sendTransferMessage(dataChannel, message)
+}
+
+// transferChannel はファイル転送のデータチャネル
+// ファイルの内容の送信中は送信バッファの空きを待ち、データチャネルが閉じた場合は待つのをやめる
+type transferChannel struct {
+	dataChannel         *webrtc.DataChannel
+	bufferedAmountLowCh chan struct{}
+	closedCh            chan struct{}
+	closeOnce           sync.Once
+}
+
+// newTransferChannel はdataChannelのOnBufferedAmountLowを設定する
+// OnCloseで使用する側がcloseを呼ぶ
+func newTransferChannel(dataChannel *webrtc.DataChannel) *transferChannel {
+	return &transferChannel{
+		dataChannel:         dataChannel,
+		bufferedAmountLowCh: watchBufferedAmountLow(dataChannel),
+		closedCh:            make(chan struct{}),
+	}
+}
+
+func (c *transferChannel) close() {
+	c.closeOnce.Do(func() { close(c.closedCh) })
+}
+
+// sendFile はヘッダー(put/file)、ファイルの内容、endを順に送信する
+func sendFile(channel *transferChannel, header *transferMessage, filePath string, progress func(int64, int64)) error {
+	dataChannel := channel.dataChannel
+	file, err := os.Open(filePath)
+	if err != nil {
+		return errors.New("fail to open file: " + filePath)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return errors.New("not a regular file: " + filePath)
+	}
+	header.Name = filepath.Base(filePath)
+	header.Size = info.Size()
+	header.Mode = uint32(info.Mode().Perm())
+	header.ModTime = info.ModTime().UnixNano()
+	err = sendTransferMessage(dataChannel, header)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	buf := make([]byte, transferChunkSize)
+	var sent int64
+	if progress != nil {
+		progress(0, header.Size)
+	}
+	for {
+		readLen, err := file.Read(buf)
+		if readLen > 0 {
+			if !waitBufferedAmountLow(dataChannel, channel.bufferedAmountLowCh, channel.closedCh) {
+				return errors.New("transfer channel is closed")
+			}
+			hash.Write(buf[:readLen])
+			err := dataChannel.Send(buf[:readLen])
+			if err != nil {
+				return err
+			}
+			sent += int64(readLen)
+			if progress != nil {
+				progress(sent, header.Size)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.New("fail to read file: " + filePath)
+		}
+	}
+	return sendTransferMessage(dataChannel, &transferMessage{Type: transferTypeEnd, SHA256: hex.EncodeToString(hash.Sum(nil))})
+}
+
+// fileReceiver は受信したファイルの内容を一時ファイルに書き込み、検証後に置き換える
+type fileReceiver struct {
+	filePath string
+	file     *os.File
+	hash     hash.Hash
+	header   transferMessage
+	received int64
+	err      error
+	progress func(int64, int64)
+}
+
+// newFileReceiver はfilePathと同じディレクトリに一時ファイルを作成する
+// filePathがディレクトリの場合はその中にnameのファイルを作成する
+func newFileReceiver(filePath, name string, header *transferMessage, progress func(int64, int64)) (*fileReceiver, error) {
+	info, err := os.Stat(filePath)
+	if err == nil && info.IsDir() {
+		name = filepath.Base(name)
+		if name == "." || name == ".." || name == string(filepath.Separator) {
+			return nil, errors.New("invalid file name: " + name)
+		}
+		filePath = filepath.Join(filePath, name)
+	}
+	file, err := ioutil.TempFile(filepath.Dir(filePath), "."+filepath.Base(filePath)+".")
+	if err != nil {
+		return nil, errors.New("fail to create file: " + filePath)
+	}
+	if progress != nil {
+		progress(0, header.Size)
+	}
+	return &fileReceiver{filePath: filePath, file: file, hash: sha256.New(), header: *header, progress: progress}, nil
+}
+
+func (r *fileReceiver) write(data []byte) {
+	if r.err != nil {
+		return
+	}
+	_, r.err = r.file.Write(data)
+	r.hash.Write(data)
+	r.received += int64(len(data))
+	if r.progress != nil && len(data) > 0 {
+		r.progress(r.received, r.header.Size)
+	}
+}
+
+// finish はサイズとSHA-256を検証し、権限と更新日時を設定して置き換える
+// 失敗した場合は一時ファイルを削除する
+func (r *fileReceiver) finish(sum string) error {
+	err := r.complete(sum)
+	if err != nil {
+		r.file.Close()
+		os.Remove(r.file.Name())
+	}
+	return err
+}
+
+func (r *fileReceiver) complete(sum string) error {
+	if r.err != nil {
+		return errors.New("fail to write file: " + r.filePath)
+	}
+	if r.received != r.header.Size {
+		return errors.New("size mismatch: " + r.filePath)
+	}
+	if hex.EncodeToString(r.hash.Sum(nil)) != sum {
+		return errors.New("sha256 mismatch: " + r.filePath)
+	}
+	err := r.file.Close()
+	if err != nil {
+		return errors.New("fail to write file: " + r.filePath)
+	}
+	modTime := time.Unix(0, r.header.ModTime)
+	err = os.Chmod(r.file.Name(), os.FileMode(r.header.Mode).Perm())
+	if err == nil {
+		err = os.Chtimes(r.file.Name(), modTime, modTime)
+	}
+	if err == nil {
+		err = os.Rename(r.file.Name(), r.filePath)
+	}
+	if err != nil {
+		return errors.New("fail to save file: " + r.filePath)
+	}
+	return nil
+}
+
+func (r *fileReceiver) abort() {
+	r.file.Close()
+	os.Remove(r.file.Name())
+}
+
+// resolveDevicePath は相対パスをデバイス側のホームディレクトリからのパスとして扱う
+func resolveDevicePath(filePath string) string {
+	if filepath.IsAbs(filePath) {
+		return filePath
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filePath
+	}
+	return filepath.Join(home, filePath)
+}
+
+// acceptTransferChannel はファイル転送のデータチャネルであればデバイス側の送受信を行う
+func acceptTransferChannel(dataChannel *webrtc.DataChannel) bool {
+	if dataChannel.Label() != transferChannelLabel {
+		return false
+	}
+	channel := newTransferChannel(dataChannel)
+	// receiverはOnMessageとOnCloseから操作する
+	var mu sync.Mutex
+	var receiver *fileReceiver
+	dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !msg.IsString {
+			if receiver != nil {
+				receiver.write(msg.Data)
+			}
+			return
+		}
+		var message transferMessage
+		err := json.Unmarshal(msg.Data, &message)
+		if err != nil {
+			sendTransferResult(dataChannel, errors.New("invalid transfer message"))
+			return
+		}
+		switch message.Type {
+		case transferTypePut:
+			if receiver != nil {
+				receiver.abort()
+			}
+			filePath := resolveDevicePath(message.Path)
+			// 保存先がディレクトリの場合はPC側のファイル名で保存する
+			name := message.Name
+			if name == "" {
+				name = filePath
+			}
+			receiver, err = newFileReceiver(filePath, name, &message, nil)
+			if err != nil {
+				sendTransferResult(dataChannel, err)
+			}
+		case transferTypeEnd:
+			if receiver == nil {
+				return
+			}
+			sendTransferResult(dataChannel, receiver.finish(message.SHA256))
+			receiver = nil
+		case transferTypeGet:
+			go func() {
+				err := sendFile(channel, &transferMessage{Type: transferTypeFile}, resolveDevicePath(message.Path), nil)
+				if err != nil {
+					sendTransferResult(dataChannel, err)
+				}
+			}()
+		}
+	})
+	dataChannel.OnClose(func() {
+		channel.close()
+		mu.Lock()
+		defer mu.Unlock()
+		if receiver != nil {
+			receiver.abort()
+			receiver = nil
+		}
+	})
+	return true
+}
+
+// openTransferChannel はファイル転送のデータチャネルを作成し、開くまで待つ
+func openTransferChannel(peerConnection *webrtc.PeerConnection, done *sessionDone, openTimeout time.Duration, onMessage func(webrtc.DataChannelMessage)) (*transferChannel, error) {
+	dataChannel, err := peerConnection.CreateDataChannel(transferChannelLabel, nil)
+	if err != nil {
+		return nil, errors.New("fail to create transfer channel")
+	}
+	channel := newTransferChannel(dataChannel)
+	openCh := make(chan bool, 1)
+	dataChannel.OnOpen(func() {
+		openCh <- true
+	})
+	dataChannel.OnMessage(onMessage)
+	dataChannel.OnClose(channel.close)
+	err = waitDataChannelOpen(openCh, done, openTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
+
+// putFile はPC側のファイルをデバイス側に送信する
+// remotePathが空の場合はホームディレクトリにファイル名で保存する
+func putFile(peerConnection *webrtc.PeerConnection, done *sessionDone, openTimeout time.Duration, localPath, remotePath string, progress func(int64, int64)) error {
+	if remotePath == "" {
+		remotePath = filepath.Base(localPath)
+	}
+	// 送信の失敗とデバイス側の結果が両方届いても止まらないようにする
+	resultCh := make(chan error, 2)
+	channel, err := openTransferChannel(peerConnection, done, openTimeout, func(msg webrtc.DataChannelMessage) {
+		var message transferMessage
+		if !msg.IsString || json.Unmarshal(msg.Data, &message) != nil || message.Type != transferTypeResult {
+			return
+		}
+		if message.Message != "" {
+			resultCh <- errors.New(message.Message)
+		} else {
+			resultCh <- nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer channel.close()
+	defer channel.dataChannel.Close()
+	go func() {
+		err := sendFile(channel, &transferMessage{Type: transferTypePut, Path: remotePath}, localPath, progress)
+		if err != nil {
+			resultCh <- err
+		}
+	}()
+	select {
+	case err = <-resultCh:
+		return err
+	case <-done.done():
+		return errors.New("session closed")
+	}
+}
+
+// getFile はデバイス側のファイルを受信する
+// localPathが空の場合はカレントディレクトリにファイル名で保存する
+func getFile(peerConnection *webrtc.PeerConnection, done *sessionDone, openTimeout time.Duration, remotePath, localPath string, progress func(int64, int64)) error {
+	if localPath == "" {
+		localPath = "."
+	}
+	// 受信側の失敗とデバイス側の送信の失敗が両方届いても受信処理が止まらないようにする
+	resultCh := make(chan error, 2)
+	// receiverはOnMessageと転送の終了時に操作する
+	var mu sync.Mutex
+	var receiver *fileReceiver
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if receiver != nil {
+			receiver.abort()
+			receiver = nil
+		}
+	}()
+	channel, err := openTransferChannel(peerConnection, done, openTimeout, func(msg webrtc.DataChannelMessage) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !msg.IsString {
+			if receiver != nil {
+				receiver.write(msg.Data)
+			}
+			return
+		}
+		var message transferMessage
+		if json.Unmarshal(msg.Data, &message) != nil {
+			return
+		}
+		switch message.Type {
+		case transferTypeFile:
+			var err error
+			receiver, err = newFileReceiver(localPath, remotePath, &message, progress)
+			if err != nil {
+				resultCh <- err
+			}
+		case transferTypeEnd:
+			if receiver == nil {
+				return
+			}
+			err := receiver.finish(message.SHA256)
+			receiver = nil
+			resultCh <- err
+		case transferTypeResult:
+			if message.Message != "" {
+				resultCh <- errors.New(message.Message)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer channel.dataChannel.Close()
+	err = sendTransferMessage(channel.dataChannel, &transferMessage{Type: transferTypeGet, Path: remotePath})
+	if err != nil {
+		return err
+	}
+	select {
+	case err = <-resultCh:
+		return err
+	case <-done.done():
+		return errors.New("session closed")
+	}
+}
+
+// printProgress は転送の進捗を標準エラー出力に表示する
+// 端末がrawモードの場合でも表示が崩れないように行頭に戻して上書きする
+func printProgress(name string) func(int64, int64) {
+	return func(transferred, total int64) {
+		percent := int64(100)
+		if total > 0 {
+			percent = transferred * 100 / total
+		}
+		fmt.Fprintf(os.Stderr, "\r%s %3d%% %d/%d bytes", name, percent, transferred, total)
+		if transferred == total {
+			fmt.Fprint(os.Stderr, "\r\n")
+		}
+	}
+}
+
+// runTransferMode はシェルを起動せずに接続し、put/getを1回実行する
+// putの引数は"ローカルのパス [デバイス側のパス]"、getの引数は"デバイス側のパス [ローカルのパス]"
+func runTransferMode(selector *deviceSelector, client *soracomClient, config *sessionConfig, operation string, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: --mode " + operation + " source [destination]")
+	}
+	source := args[0]
+	destination := ""
+	if len(args) == 2 {
+		destination = args[1]
+	}
+	trickleCtx, cancelTrickle := context.WithTimeout(context.Background(), config.signalingTimeout)
+	defer cancelTrickle()
+	peerConnection, control, done, err := connectWithoutShell(trickleCtx, selector, client, config)
+	if err != nil {
+		return err
+	}
+	defer peerConnection.Close()
+	defer control.send(&controlMessage{Type: controlTypeExit})
+	if operation == transferTypePut {
+		return putFile(peerConnection, done, config.signalingTimeout, source, destination, printProgress(filepath.Base(source)))
+	}
+	return getFile(peerConnection, done, config.signalingTimeout, source, destination, printProgress(filepath.Base(source)))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestFileReceiver(t *testing.T) {
+	content := []byte("firmware image")
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name    string
+		chunks  []string
+		size    int64
+		sum     string
+		wantErr string
+	}{
+		{name: "ok", chunks: []string{"firmware", " image"}, size: int64(len(content)), sum: sha256Hex(content)},
+		{name: "empty", chunks: nil, size: 0, sum: sha256Hex(nil)},
+		{name: "short", chunks: []string{"firmware"}, size: int64(len(content)), sum: sha256Hex(content), wantErr: "size mismatch"},
+		{name: "long", chunks: []string{"firmware", " image", "!"}, size: int64(len(content)), sum: sha256Hex(content), wantErr: "size mismatch"},
+		{name: "corrupt", chunks: []string{"firmware", " imagf"}, size: int64(len(content)), sum: sha256Hex(content), wantErr: "sha256 mismatch"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			filePath := filepath.Join(dir, "firmware.bin")
+			header := &transferMessage{Type: transferTypePut, Size: test.size, Mode: 0640, ModTime: modTime.UnixNano()}
+			receiver, err := newFileReceiver(filePath, "firmware.bin", header, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, chunk := range test.chunks {
+				receiver.write([]byte(chunk))
+			}
+			err = receiver.finish(test.sum)
+			files, _ := ioutil.ReadDir(dir)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("err = %v, want %q", err, test.wantErr)
+				}
+				// 失敗した場合は一時ファイルを残さない
+				if len(files) != 0 {
+					t.Fatalf("%d files left after failure", len(files))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 1 {
+				t.Fatalf("%d files in destination, want 1", len(files))
+			}
+			info, err := os.Stat(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0640 {
+				t.Errorf("mode = %v, want %v", info.Mode().Perm(), os.FileMode(0640))
+			}
+			if !info.ModTime().Equal(modTime) {
+				t.Errorf("modTime = %v, want %v", info.ModTime(), modTime)
+			}
+			data, err := ioutil.ReadFile(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != strings.Join(test.chunks, "") {
+				t.Errorf("content = %q, want %q", data, strings.Join(test.chunks, ""))
+			}
+		})
+	}
+}
+
+func TestFileReceiverDestination(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		filePath string
+		name     string
+		want     string
+		wantErr  bool
+	}{
+		// 保存先がディレクトリの場合は送信元のファイル名で保存する
+		{filePath: dir, name: "firmware.bin", want: filepath.Join(dir, "firmware.bin")},
+		{filePath: dir + "/", name: "firmware.bin", want: filepath.Join(dir, "firmware.bin")},
+		{filePath: dir, name: "/home/pi/firmware.bin", want: filepath.Join(dir, "firmware.bin")},
+		{filePath: filepath.Join(dir, "renamed.bin"), name: "firmware.bin", want: filepath.Join(dir, "renamed.bin")},
+		{filePath: dir, name: "..", wantErr: true},
+		{filePath: dir, name: "/", wantErr: true},
+		{filePath: filepath.Join(dir, "missing", "firmware.bin"), name: "firmware.bin", wantErr: true},
+	}
+	for _, test := range tests {
+		receiver, err := newFileReceiver(test.filePath, test.name, &transferMessage{Type: transferTypePut}, nil)
+		if test.wantErr {
+			if err == nil {
+				receiver.abort()
+				t.Errorf("%s, %s: want error", test.filePath, test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s, %s: %v", test.filePath, test.name, err)
+			continue
+		}
+		receiver.abort()
+		if receiver.filePath != test.want {
+			t.Errorf("%s, %s: filePath = %s, want %s", test.filePath, test.name, receiver.filePath, test.want)
+		}
+	}
+}
+
+func TestResolveDevicePath(t *testing.T) {
+	t.Setenv("HOME", "/home/pi")
+	tests := []struct {
+		filePath string
+		want     string
+	}{
+		{filePath: "/tmp/firmware.bin", want: "/tmp/firmware.bin"},
+		{filePath: "firmware.bin", want: "/home/pi/firmware.bin"},
+		{filePath: "logs/../firmware.bin", want: "/home/pi/firmware.bin"},
+		{filePath: ".", want: "/home/pi"},
+	}
+	for _, test := range tests {
+		if got := resolveDevicePath(test.filePath); got != test.want {
+			t.Errorf("%s: path = %s, want %s", test.filePath, got, test.want)
+		}
+	}
+}
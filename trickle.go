@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc"
+)
+
+// 候補の収集を通知されてから書き込むまでの待ち時間
+// 短時間に収集した候補をまとめて書き込み、APIの呼び出し回数を減らす
+const candidateBatchInterval = 200 * time.Millisecond
+
+// trickleICE はoffer/answerの送信後に収集したICE候補をシグナリング経路で相手と交換する
+// ICEの接続が確立した後は候補の書き込みと読み出しをやめ、接続に失敗した場合はonFailedを呼ぶ
+type trickleICE struct {
+	sig         signaler
+	mu          sync.Mutex
+	candidates  []webrtc.ICECandidateInit
+	complete    bool
+	updateCh    chan struct{}
+	connectedCh chan struct{}
+	connectOnce sync.Once
+}
+
+// newTrickleICE はICE候補の収集を開始する前(SetLocalDescriptionの前)に呼ぶ
+func newTrickleICE(peerConnection *webrtc.PeerConnection, sig signaler, onFailed func()) *trickleICE {
+	t := &trickleICE{sig: sig, updateCh: make(chan struct{}, 1), connectedCh: make(chan struct{})}
+	peerConnection.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		switch state {
+		case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+			t.connectOnce.Do(func() { close(t.connectedCh) })
+		case webrtc.ICEConnectionStateFailed:
+			fmt.Fprintln(os.Stderr, "webrtc connection failed")
+			onFailed()
+		}
+	})
+	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		t.mu.Lock()
+		if candidate == nil {
+			t.complete = true
+		} else {
+			t.candidates = append(t.candidates, candidate.ToJSON())
+		}
+		t.mu.Unlock()
+		select {
+		case t.updateCh <- struct{}{}:
+		default:
+		}
+	})
+	return t
+}
+
+// startPublishing は収集済みの候補と以降に収集した候補を書き込む
+// セッションIDが決まった後(offer/answerの送信後)に呼ぶ
+func (t *trickleICE) startPublishing(ctx context.Context) {
+	go func() {
+		for {
+			t.mu.Lock()
+			candidates := append([]webrtc.ICECandidateInit{}, t.candidates...)
+			complete := t.complete
+			t.mu.Unlock()
+			err := t.sig.publishCandidates(candidates, complete)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			if complete {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.connectedCh:
+				return
+			case <-t.updateCh:
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.connectedCh:
+				return
+			case <-time.After(candidateBatchInterval):
+			}
+		}
+	}()
+}
+
+// startReceiving は相手の候補を読み出してpeerConnectionに追加する
+// remote descriptionを設定した後に呼ぶ
+func (t *trickleICE) startReceiving(ctx context.Context, peerConnection *webrtc.PeerConnection) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-t.connectedCh:
+			cancel()
+		}
+	}()
+	go func() {
+		defer cancel()
+		t.sig.awaitCandidates(ctx, func(candidate webrtc.ICECandidateInit) {
+			err := peerConnection.AddICECandidate(candidate)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "fail to add ice candidate")
+			}
+		})
+	}()
+}